@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/drmitchell85/finsys/internal/auth"
+	"github.com/drmitchell85/finsys/internal/config"
+	"github.com/drmitchell85/finsys/internal/models"
+	"github.com/drmitchell85/finsys/internal/store"
+	"github.com/google/uuid"
+)
+
+// issues an api key for a user. the raw key is printed once and never stored.
+func main() {
+	userFlag := flag.String("user", "", "id of the user the key acts as")
+	name := flag.String("name", "", "label to identify the key")
+	scopes := flag.String("scopes", string(auth.ScopeTransactionsRead)+","+string(auth.ScopeTransactionsWrite), "comma separated scopes")
+	ttl := flag.Duration("ttl", 0, "how long the key is valid for, 0 for no expiry")
+	flag.Parse()
+
+	userID, err := uuid.Parse(*userFlag)
+	if err != nil {
+		log.Fatalf("-user must be a valid uuid: %s", err)
+	}
+	if *name == "" {
+		log.Fatalf("-name is required")
+	}
+
+	config, err := config.Load()
+	if err != nil {
+		log.Fatalf("error loading config: %s", err)
+	}
+
+	db, err := store.InitDB(*config)
+	if err != nil {
+		log.Fatalf("error starting db: %s", err)
+	}
+	defer db.Close()
+
+	rawKey, prefix, err := auth.GenerateKey()
+	if err != nil {
+		log.Fatalf("%s", err)
+	}
+
+	key := &models.APIKey{
+		UserID: userID,
+		Name:   *name,
+		Prefix: prefix,
+		Scopes: strings.Split(*scopes, ","),
+	}
+	if *ttl > 0 {
+		expiresAt := time.Now().Add(*ttl)
+		key.ExpiresAt = &expiresAt
+	}
+
+	rs := store.NewRepositoryService(db, nil)
+	err = rs.CreateAPIKey(context.Background(), key, auth.HashKey(rawKey))
+	if err != nil {
+		log.Fatalf("error creating api key: %s", err)
+	}
+
+	fmt.Printf("created api key %s (%s) for user %s\n", key.ID, key.Prefix, key.UserID)
+	fmt.Println(rawKey)
+}
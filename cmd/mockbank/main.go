@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/drmitchell85/finsys/internal/bank"
+	"github.com/drmitchell85/finsys/internal/config"
+	"github.com/drmitchell85/finsys/internal/store"
+)
+
+// mockbank serves the mock_accounts and mock_reservations tables over http,
+// so the transaction service can talk to the bank like an external provider
+func main() {
+	config, err := config.Load()
+	if err != nil {
+		log.Fatalf("error loading config: %s", err)
+	}
+
+	db, err := store.InitDB(*config)
+	if err != nil {
+		log.Fatalf("error starting db: %s", err)
+	}
+	defer db.Close()
+
+	bs := bank.NewBankService(db, config.Bank.Mock)
+	if config.Bank.Mock.WebhookURL != "" {
+		if config.Bank.Mock.WebhookSecret != "" {
+			bs = bank.NewWebhookEmitter(bs, &http.Client{Timeout: 5 * time.Second}, config.Bank.Mock.WebhookURL, config.Bank.Mock.WebhookSecret)
+			log.Printf("mock bank calling back to %s\n", config.Bank.Mock.WebhookURL)
+		} else {
+			log.Println("WARN: no webhook secret for the mock bank, not sending callbacks")
+		}
+	}
+
+	httpServer := &http.Server{
+		Addr:    ":" + fmt.Sprintf("%d", config.Bank.Mock.Port),
+		Handler: bank.NewHandler(bs),
+	}
+
+	errc := make(chan error, 1)
+	sigc := make(chan os.Signal, 1)
+	signal.Notify(sigc, syscall.SIGTERM, syscall.SIGINT)
+
+	go func() {
+		log.Printf("mock bank listening on %s\n", httpServer.Addr)
+		if err := httpServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			errc <- err
+		}
+	}()
+
+	select {
+	case <-sigc:
+		log.Println("received signal to shut down mock bank...")
+	case err := <-errc:
+		log.Printf("mock bank failed: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	if err := httpServer.Shutdown(ctx); err != nil {
+		log.Printf("error shutting down mock bank: %v", err)
+	}
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"context"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/drmitchell85/finsys/internal/worker"
+)
+
+func main() {
+	transactionWorker, err := worker.NewWorker()
+	if err != nil {
+		log.Fatalf("Error starting transaction worker: %s", err)
+	}
+
+	errc := make(chan error)
+	sigc := make(chan os.Signal, 1)
+	signal.Notify(sigc, syscall.SIGTERM, syscall.SIGINT)
+
+	go func() {
+		err = transactionWorker.Start()
+		if err != nil {
+			errc <- err
+		}
+	}()
+
+	select {
+	case <-sigc:
+		log.Println("received signal to shut down transaction worker...")
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		transactionWorker.Shutdown(ctx)
+		cancel()
+
+	case err := <-errc:
+		log.Printf("transaction worker stopped unexpectedly: %v", err)
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		transactionWorker.Shutdown(ctx)
+		cancel()
+	}
+
+	os.Exit(0)
+}
@@ -79,3 +79,145 @@ FOREIGN KEY (bank_reservation_id) REFERENCES mock_reservations(id);
 
 ALTER TABLE accounts DROP CONSTRAINT fk_accounts_external_bank;
 ALTER TABLE transactions DROP CONSTRAINT fk_transactions_reservation;
+
+CREATE TABLE transaction_status_history (
+    id BIGSERIAL PRIMARY KEY,
+    transaction_id UUID NOT NULL REFERENCES transactions(id),
+    from_status transaction_status, -- null for the initial insert
+    to_status transaction_status NOT NULL,
+    reason TEXT,
+    created_at TIMESTAMP DEFAULT NOW()
+);
+
+CREATE INDEX idx_transaction_status_history_transaction ON transaction_status_history(transaction_id, created_at);
+
+CREATE TABLE journal_entries (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    transaction_id UUID NOT NULL REFERENCES transactions(id),
+    event VARCHAR(20) NOT NULL, -- created/completed/failed/cancelled
+    created_at TIMESTAMP DEFAULT NOW(),
+    UNIQUE (transaction_id, event)
+);
+
+CREATE TABLE postings (
+    id BIGSERIAL PRIMARY KEY,
+    journal_entry_id UUID NOT NULL REFERENCES journal_entries(id),
+    account_id UUID NOT NULL REFERENCES accounts(id),
+    account_kind VARCHAR(20) NOT NULL, -- available/pending/clearing
+    direction VARCHAR(6) NOT NULL CHECK (direction IN ('debit', 'credit')),
+    amount DECIMAL(15,2) NOT NULL CHECK (amount > 0),
+    currency VARCHAR(3) NOT NULL,
+    created_at TIMESTAMP DEFAULT NOW()
+);
+
+CREATE INDEX idx_postings_account ON postings(account_id, account_kind, currency);
+CREATE INDEX idx_postings_journal_entry ON postings(journal_entry_id);
+
+CREATE INDEX idx_transactions_from_account_created ON transactions(from_account_id, created_at DESC, id DESC);
+CREATE INDEX idx_transactions_to_account_created ON transactions(to_account_id, created_at DESC, id DESC);
+
+CREATE INDEX idx_transactions_metadata ON transactions USING GIN (metadata jsonb_path_ops);
+
+CREATE TABLE outbox (
+    id BIGSERIAL PRIMARY KEY,
+    message_type VARCHAR(50) NOT NULL, -- transaction/notification
+    payload JSONB NOT NULL,
+    dedup_key VARCHAR(255) NOT NULL,
+    attempts INT NOT NULL DEFAULT 0,
+    last_error TEXT,
+    next_attempt_at TIMESTAMP NOT NULL DEFAULT NOW(),
+    sent_at TIMESTAMP,
+    created_at TIMESTAMP DEFAULT NOW()
+);
+
+CREATE INDEX idx_outbox_unsent ON outbox(next_attempt_at) WHERE sent_at IS NULL;
+
+-- backing table for the postgres queue backend (sqs.backend: postgres)
+CREATE TABLE queue_messages (
+    id BIGSERIAL PRIMARY KEY,
+    queue VARCHAR(255) NOT NULL,
+    body TEXT NOT NULL,
+    dedup_key VARCHAR(255),
+    receipt_handle UUID,
+    receive_count INT NOT NULL DEFAULT 0,
+    visible_at TIMESTAMP NOT NULL DEFAULT NOW(),
+    created_at TIMESTAMP DEFAULT NOW()
+);
+
+CREATE UNIQUE INDEX idx_queue_messages_dedup ON queue_messages(queue, dedup_key);
+CREATE INDEX idx_queue_messages_visible ON queue_messages(queue, visible_at);
+
+CREATE TYPE mock_reservation_status AS ENUM ('active', 'released', 'captured');
+
+ALTER TABLE mock_reservations ADD COLUMN status mock_reservation_status NOT NULL DEFAULT 'active';
+ALTER TABLE mock_reservations ADD COLUMN released_at TIMESTAMP;
+ALTER TABLE mock_reservations ADD COLUMN captured_at TIMESTAMP;
+
+CREATE TYPE api_key_status AS ENUM ('active', 'revoked');
+
+CREATE TABLE api_keys (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    user_id UUID NOT NULL REFERENCES users(id),
+    name VARCHAR(100) NOT NULL,
+    key_prefix VARCHAR(12) NOT NULL, -- first characters of the key, for identification
+    key_hash VARCHAR(64) UNIQUE NOT NULL, -- sha256 of the full key, the key itself is never stored
+    scopes TEXT[] NOT NULL DEFAULT '{}',
+    status api_key_status NOT NULL DEFAULT 'active',
+    expires_at TIMESTAMP,
+    last_used_at TIMESTAMP,
+    created_at TIMESTAMP DEFAULT NOW()
+);
+
+CREATE INDEX idx_api_keys_user ON api_keys(user_id);
+
+-- fencing token of the last holder of the per-account lock that wrote
+ALTER TABLE accounts ADD COLUMN lock_token BIGINT NOT NULL DEFAULT 0;
+
+-- fingerprint of the request that created the transaction, to reject reused idempotency keys
+ALTER TABLE transactions ADD COLUMN request_hash TEXT;
+
+-- idempotency keys are unique per client rather than across every tenant
+ALTER TABLE transactions ADD COLUMN client_id TEXT;
+
+UPDATE transactions t SET client_id = 'user:' || a.user_id
+FROM accounts a
+WHERE a.id = t.from_account_id AND t.client_id IS NULL;
+
+ALTER TABLE transactions ALTER COLUMN client_id SET NOT NULL;
+ALTER TABLE transactions DROP CONSTRAINT transactions_idempotency_key_key;
+ALTER TABLE transactions ADD CONSTRAINT transactions_client_idempotency_key UNIQUE (client_id, idempotency_key);
+
+-- which payment provider holds the funds, external_provider_id is its reference
+ALTER TABLE transactions ADD COLUMN provider_name VARCHAR(50);
+
+-- webhooks look transactions up by the provider's reference
+CREATE INDEX idx_transactions_provider_ref ON transactions(provider_name, external_provider_id);
+
+-- provider webhook events already applied, so redeliveries are dropped
+CREATE TABLE provider_events (
+    provider VARCHAR(50) NOT NULL,
+    event_id VARCHAR(255) NOT NULL,
+    type VARCHAR(50) NOT NULL,
+    transaction_id UUID NOT NULL REFERENCES transactions(id),
+    received_at TIMESTAMP DEFAULT NOW(),
+    PRIMARY KEY (provider, event_id)
+);
+
+-- fencing tokens for the per-account lock come from postgres rather than a
+-- redis counter, which starts over if redis loses its data
+CREATE SEQUENCE lock_fence_seq;
+SELECT setval('lock_fence_seq', GREATEST((SELECT MAX(lock_token) FROM accounts), 1));
+
+-- when the provider drops the hold, so expiry is known without asking the bank
+ALTER TABLE transactions ADD COLUMN reservation_expires_at TIMESTAMP;
+
+UPDATE transactions t SET reservation_expires_at = mr.expires_at
+FROM mock_reservations mr
+WHERE mr.id = t.bank_reservation_id AND t.reservation_expires_at IS NULL;
+
+CREATE INDEX idx_transactions_reservation_expiry ON transactions(reservation_expires_at)
+WHERE status IN ('pending', 'processing');
+
+-- when the sweeper last failed to expire a transaction, so one whose release
+-- keeps failing backs off instead of filling every batch
+ALTER TABLE transactions ADD COLUMN expiry_attempted_at TIMESTAMP;
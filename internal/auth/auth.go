@@ -0,0 +1,164 @@
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/drmitchell85/finsys/internal/config"
+	"github.com/drmitchell85/finsys/internal/store"
+	"github.com/drmitchell85/finsys/internal/utils"
+	"github.com/google/uuid"
+	"github.com/redis/go-redis/v9"
+)
+
+type Scope string
+
+const (
+	ScopeTransactionsRead  Scope = "transactions:read"
+	ScopeTransactionsWrite Scope = "transactions:write"
+)
+
+// api keys look like fsk_<random>, the first keyPrefixLength characters are
+// stored in the clear so a key can be identified without knowing it
+const (
+	keyPrefix       = "fsk_"
+	keyPrefixLength = 12
+	keyRandomBytes  = 32
+)
+
+// Principal is the authenticated caller of a request
+type Principal struct {
+	UserID   uuid.UUID
+	KeyID    uuid.UUID // set for api key callers
+	ClientID string    // set for hmac callers
+	Scopes   []Scope
+}
+
+func (p *Principal) HasScope(scope Scope) bool {
+	for _, s := range p.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+type principalKey struct{}
+
+// Namespace is what the caller's idempotency keys are scoped to. api keys
+// share their user's namespace, hmac clients get their own
+func (p *Principal) Namespace() string {
+	if p.ClientID != "" {
+		return "client:" + p.ClientID
+	}
+	return "user:" + p.UserID.String()
+}
+
+func WithPrincipal(ctx context.Context, p *Principal) context.Context {
+	return context.WithValue(ctx, principalKey{}, p)
+}
+
+func PrincipalFromContext(ctx context.Context) (*Principal, bool) {
+	p, ok := ctx.Value(principalKey{}).(*Principal)
+	return p, ok
+}
+
+// HashKey is how api keys are stored. Keys are long random strings, so a
+// plain sha256 is enough, there's nothing to brute force.
+func HashKey(rawKey string) string {
+	sum := sha256.Sum256([]byte(rawKey))
+	return hex.EncodeToString(sum[:])
+}
+
+// GenerateKey returns a new raw api key and the prefix to store alongside its hash
+func GenerateKey() (string, string, error) {
+	buf := make([]byte, keyRandomBytes)
+	if _, err := rand.Read(buf); err != nil {
+		return "", "", fmt.Errorf("error generating api key: %w", err)
+	}
+
+	rawKey := keyPrefix + base64.RawURLEncoding.EncodeToString(buf)
+	return rawKey, rawKey[:keyPrefixLength], nil
+}
+
+type AuthService interface {
+	AuthenticateAPIKey(ctx context.Context, rawKey string) (*Principal, error)
+	AuthenticateHMAC(ctx context.Context, req SignedRequest) (*Principal, error)
+}
+
+type hmacClient struct {
+	secret string
+	userID uuid.UUID
+	scopes []Scope
+}
+
+type authService struct {
+	rs           store.RepositoryService
+	redis        *redis.Client // for the hmac replay cache
+	hmacClients  map[string]hmacClient
+	replayWindow time.Duration
+}
+
+func NewAuthService(rs store.RepositoryService, redis *redis.Client, config config.AuthConfig) (AuthService, error) {
+	clients := map[string]hmacClient{}
+	for _, c := range config.HMAC.Clients {
+		userID, err := uuid.Parse(c.UserID)
+		if err != nil {
+			return nil, fmt.Errorf("invalid user id for hmac client %s: %w", c.ID, err)
+		}
+
+		clients[c.ID] = hmacClient{
+			secret: c.Secret,
+			userID: userID,
+			scopes: toScopes(c.Scopes),
+		}
+	}
+
+	return &authService{
+		rs:           rs,
+		redis:        redis,
+		hmacClients:  clients,
+		replayWindow: config.HMAC.ReplayWindow,
+	}, nil
+}
+
+func toScopes(values []string) []Scope {
+	scopes := make([]Scope, 0, len(values))
+	for _, v := range values {
+		scopes = append(scopes, Scope(v))
+	}
+	return scopes
+}
+
+func (as *authService) AuthenticateAPIKey(ctx context.Context, rawKey string) (*Principal, error) {
+	if !strings.HasPrefix(rawKey, keyPrefix) {
+		return nil, utils.NewUnauthorizedError("invalid api key", fmt.Errorf("malformed api key"))
+	}
+
+	key, err := as.rs.GetAPIKeyByHash(ctx, HashKey(rawKey))
+	if err != nil {
+		return nil, err
+	}
+	if key == nil {
+		return nil, utils.NewUnauthorizedError("invalid api key", fmt.Errorf("unknown api key"))
+	}
+
+	if key.Status != "active" {
+		return nil, utils.NewUnauthorizedError("api key revoked", fmt.Errorf("api key %s is %s", key.ID, key.Status))
+	}
+	if key.ExpiresAt != nil && key.ExpiresAt.Before(time.Now()) {
+		return nil, utils.NewUnauthorizedError("api key expired", fmt.Errorf("api key %s expired", key.ID))
+	}
+
+	return &Principal{
+		UserID: key.UserID,
+		KeyID:  key.ID,
+		Scopes: toScopes(key.Scopes),
+	}, nil
+}
@@ -6,31 +6,35 @@ import (
 	"fmt"
 	"time"
 
+	"github.com/drmitchell85/finsys/internal/config"
 	"github.com/drmitchell85/finsys/internal/utils"
 	"github.com/google/uuid"
 	"github.com/shopspring/decimal"
-	"golang.org/x/exp/rand"
 )
 
 type BankService interface {
 	HasSufficientFunds(ctx context.Context, accountID uuid.UUID, amount decimal.Decimal) (bool, error)
-	ReserveFunds(ctx context.Context, accountID uuid.UUID, amount decimal.Decimal) (uuid.UUID, error)
+	ReserveFunds(ctx context.Context, accountID uuid.UUID, amount decimal.Decimal) (uuid.UUID, time.Time, error) // the hold and when it lapses
 	ReleaseFunds(ctx context.Context, accountID uuid.UUID, reservationID uuid.UUID) error
+	CaptureFunds(ctx context.Context, accountID uuid.UUID, reservationID uuid.UUID) error
 }
 
 type mockBankService struct {
-	db *sql.DB
+	db     *sql.DB
+	faults *faultInjector // network latency + failure sim
 }
 
-func NewBankService(db *sql.DB) BankService {
+func NewBankService(db *sql.DB, config config.MockBankConfig) BankService {
 	return &mockBankService{
-		db: db,
+		db:     db,
+		faults: newFaultInjector(config),
 	}
 }
 
 func (m *mockBankService) HasSufficientFunds(ctx context.Context, accountID uuid.UUID, amount decimal.Decimal) (bool, error) {
-	// network latency sim
-	time.Sleep(time.Duration(rand.Intn(50)) * time.Millisecond)
+	if err := m.faults.inject(ctx, opBalance, accountID); err != nil {
+		return false, err
+	}
 
 	var availableBalance decimal.Decimal
 	var status string
@@ -41,6 +45,7 @@ func (m *mockBankService) HasSufficientFunds(ctx context.Context, accountID uuid
             ma.status
         FROM mock_accounts ma
         LEFT JOIN mock_reservations mr ON ma.id = mr.account_id 
+            AND mr.status = 'active'
             AND mr.expires_at > NOW()
         WHERE ma.id = $1
         GROUP BY ma.id, ma.balance, ma.status
@@ -49,6 +54,9 @@ func (m *mockBankService) HasSufficientFunds(ctx context.Context, accountID uuid
 	if err == sql.ErrNoRows {
 		return false, utils.NewNotFoundError(fmt.Sprintf("account not found"), err)
 	}
+	if err != nil {
+		return false, utils.NewInternalError(err)
+	}
 	if status != "active" {
 		return false, utils.NewForbiddenError(fmt.Sprintf("account %s", status), err)
 	}
@@ -56,40 +64,168 @@ func (m *mockBankService) HasSufficientFunds(ctx context.Context, accountID uuid
 	return availableBalance.GreaterThanOrEqual(amount), nil
 }
 
-func (m *mockBankService) ReserveFunds(ctx context.Context, accountID uuid.UUID, amount decimal.Decimal) (uuid.UUID, error) {
+func (m *mockBankService) ReserveFunds(ctx context.Context, accountID uuid.UUID, amount decimal.Decimal) (uuid.UUID, time.Time, error) {
+	if err := m.faults.inject(ctx, opReserve, accountID); err != nil {
+		return uuid.Nil, time.Time{}, err
+	}
+
 	tx, err := m.db.BeginTx(ctx, nil)
 	if err != nil {
-		return uuid.Nil, utils.NewInternalError(err)
+		return uuid.Nil, time.Time{}, utils.NewInternalError(err)
 	}
 	defer tx.Rollback()
 
-	// check + reserve atomically
+	// check + reserve atomically. the account row lock serializes concurrent
+	// reservations, so the holds summed below can't change under us
 	var currentBalance decimal.Decimal
 	err = tx.QueryRowContext(ctx,
 		"SELECT balance FROM mock_accounts WHERE id = $1 AND status = 'active' FOR UPDATE",
 		accountID).Scan(&currentBalance)
 
+	if err == sql.ErrNoRows {
+		return uuid.Nil, time.Time{}, utils.NewNotFoundError("active account not found", err)
+	}
+	if err != nil {
+		return uuid.Nil, time.Time{}, utils.NewInternalError(err)
+	}
+
+	var held decimal.Decimal
+	err = tx.QueryRowContext(ctx, `
+        SELECT COALESCE(SUM(amount), 0)
+        FROM mock_reservations
+        WHERE account_id = $1 AND status = 'active' AND expires_at > NOW()
+    `, accountID).Scan(&held)
+
 	if err != nil {
-		return uuid.Nil, utils.NewInternalError(err)
+		return uuid.Nil, time.Time{}, utils.NewInternalError(err)
 	}
 
-	if currentBalance.LessThan(amount) {
-		return uuid.Nil, utils.NewForbiddenError("insufficient funds", fmt.Errorf("error"))
+	available := currentBalance.Sub(held)
+	if available.LessThan(amount) {
+		return uuid.Nil, time.Time{}, utils.NewInsufficientFundsError("insufficient funds", fmt.Errorf("available %s, requested %s", available, amount))
 	}
 
 	// create reservation
 	var reservationID uuid.UUID
+	expiresAt := time.Now().Add(time.Hour)
 	err = tx.QueryRowContext(ctx,
 		"INSERT INTO mock_reservations (account_id, amount, expires_at) VALUES ($1, $2, $3) RETURNING id",
-		accountID, amount, time.Now().Add(time.Hour)).Scan(&reservationID)
+		accountID, amount, expiresAt).Scan(&reservationID)
 
 	if err != nil {
-		return uuid.Nil, utils.NewInternalError(err)
+		return uuid.Nil, time.Time{}, utils.NewInternalError(err)
 	}
 
-	return reservationID, tx.Commit()
+	return reservationID, expiresAt, tx.Commit()
 }
 
+// ReleaseFunds drops a hold without moving any money. Releasing an already
+// released reservation is a no-op so callers can retry safely.
 func (m *mockBankService) ReleaseFunds(ctx context.Context, accountID uuid.UUID, reservationID uuid.UUID) error {
+	if err := m.faults.inject(ctx, opRelease, accountID); err != nil {
+		return err
+	}
+
+	res, err := m.db.ExecContext(ctx, `
+        UPDATE mock_reservations SET status = 'released', released_at = NOW()
+        WHERE id = $1 AND account_id = $2 AND status = 'active'
+    `, reservationID, accountID)
+	if err != nil {
+		return utils.NewInternalError(err)
+	}
+
+	rows, err := res.RowsAffected()
+	if err != nil {
+		return utils.NewInternalError(err)
+	}
+	if rows > 0 {
+		return nil
+	}
+
+	status, err := m.reservationStatus(ctx, accountID, reservationID)
+	if err != nil {
+		return err
+	}
+
+	if status == "captured" {
+		return utils.NewReservationCapturedError("reservation already captured", fmt.Errorf("cannot release captured reservation %s", reservationID))
+	}
+
 	return nil
 }
+
+// CaptureFunds takes the held amount out of the account and closes the
+// reservation. Capturing an already captured reservation is a no-op.
+func (m *mockBankService) CaptureFunds(ctx context.Context, accountID uuid.UUID, reservationID uuid.UUID) error {
+	if err := m.faults.inject(ctx, opCapture, accountID); err != nil {
+		return err
+	}
+
+	tx, err := m.db.BeginTx(ctx, nil)
+	if err != nil {
+		return utils.NewInternalError(err)
+	}
+	defer tx.Rollback()
+
+	var amount decimal.Decimal
+	var status string
+	var expired bool
+	err = tx.QueryRowContext(ctx, `
+        SELECT amount, status, expires_at <= NOW()
+        FROM mock_reservations
+        WHERE id = $1 AND account_id = $2
+        FOR UPDATE
+    `, reservationID, accountID).Scan(&amount, &status, &expired)
+
+	if err == sql.ErrNoRows {
+		return utils.NewNotFoundError("reservation not found", err)
+	}
+	if err != nil {
+		return utils.NewInternalError(err)
+	}
+
+	switch {
+	case status == "captured":
+		return nil
+	case status == "released":
+		return utils.NewForbiddenError("reservation already released", fmt.Errorf("cannot capture released reservation %s", reservationID))
+	case expired:
+		return utils.NewForbiddenError("reservation expired", fmt.Errorf("cannot capture expired reservation %s", reservationID))
+	}
+
+	_, err = tx.ExecContext(ctx,
+		"UPDATE mock_accounts SET balance = balance - $1, updated_at = NOW() WHERE id = $2",
+		amount, accountID)
+	if err != nil {
+		return utils.NewInternalError(err)
+	}
+
+	_, err = tx.ExecContext(ctx,
+		"UPDATE mock_reservations SET status = 'captured', captured_at = NOW() WHERE id = $1",
+		reservationID)
+	if err != nil {
+		return utils.NewInternalError(err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return utils.NewInternalError(err)
+	}
+
+	return nil
+}
+
+func (m *mockBankService) reservationStatus(ctx context.Context, accountID uuid.UUID, reservationID uuid.UUID) (string, error) {
+	var status string
+	err := m.db.QueryRowContext(ctx,
+		"SELECT status FROM mock_reservations WHERE id = $1 AND account_id = $2",
+		reservationID, accountID).Scan(&status)
+
+	if err == sql.ErrNoRows {
+		return "", utils.NewNotFoundError("reservation not found", err)
+	}
+	if err != nil {
+		return "", utils.NewInternalError(err)
+	}
+
+	return status, nil
+}
@@ -0,0 +1,125 @@
+package bank
+
+import (
+	"context"
+	"database/sql"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/drmitchell85/finsys/internal/config"
+	"github.com/drmitchell85/finsys/internal/utils"
+	"github.com/google/uuid"
+	_ "github.com/lib/pq"
+	"github.com/shopspring/decimal"
+)
+
+// testDB connects to the postgres named in the environment, which should be
+// a throwaway database with db.sql applied
+func testDB(t *testing.T) *sql.DB {
+	t.Helper()
+
+	dsn := os.Getenv("FINSYS_TEST_DATABASE_URL")
+	if dsn == "" {
+		t.Skip("FINSYS_TEST_DATABASE_URL not set")
+	}
+
+	db, err := sql.Open("postgres", dsn)
+	if err != nil {
+		t.Fatalf("error opening db: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	return db
+}
+
+func createMockAccount(t *testing.T, db *sql.DB, balance decimal.Decimal) uuid.UUID {
+	t.Helper()
+
+	var accountID uuid.UUID
+	err := db.QueryRow("INSERT INTO mock_accounts (balance) VALUES ($1) RETURNING id", balance).Scan(&accountID)
+	if err != nil {
+		t.Fatalf("error creating mock account: %v", err)
+	}
+
+	t.Cleanup(func() {
+		db.Exec("DELETE FROM mock_reservations WHERE account_id = $1", accountID)
+		db.Exec("DELETE FROM mock_accounts WHERE id = $1", accountID)
+	})
+
+	return accountID
+}
+
+func TestConcurrentReservationsNeverExceedBalance(t *testing.T) {
+	db := testDB(t)
+	ctx := context.Background()
+
+	balance := decimal.NewFromInt(100)
+	amount := decimal.NewFromInt(7)
+	const callers = 50
+
+	accountID := createMockAccount(t, db, balance)
+
+	// a little latency so the calls overlap
+	bs := NewBankService(db, config.MockBankConfig{
+		Seed:    1,
+		Latency: config.LatencyConfig{Distribution: latencyUniform, Max: 5 * time.Millisecond},
+	})
+
+	var (
+		wg    sync.WaitGroup
+		mu    sync.Mutex
+		won   int
+		other []error
+	)
+
+	start := make(chan struct{})
+	for i := 0; i < callers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			<-start
+
+			_, _, err := bs.ReserveFunds(ctx, accountID, amount)
+
+			mu.Lock()
+			defer mu.Unlock()
+
+			if err == nil {
+				won++
+				return
+			}
+			if appErr, ok := utils.GetAppError(err); ok && appErr.Code == utils.ErrInsufficientFunds {
+				return
+			}
+			other = append(other, err)
+		}()
+	}
+	close(start)
+	wg.Wait()
+
+	for _, err := range other {
+		t.Errorf("losing reservation should fail with insufficient funds, got %v", err)
+	}
+
+	// every call that fit should have won, and no more
+	want := int(balance.Div(amount).IntPart())
+	if won != want {
+		t.Errorf("%d reservations succeeded, want %d", won, want)
+	}
+
+	var held decimal.Decimal
+	err := db.QueryRow(
+		"SELECT COALESCE(SUM(amount), 0) FROM mock_reservations WHERE account_id = $1 AND status = 'active'",
+		accountID).Scan(&held)
+	if err != nil {
+		t.Fatalf("error summing holds: %v", err)
+	}
+	if held.GreaterThan(balance) {
+		t.Errorf("holds of %s exceed balance %s", held, balance)
+	}
+	if !held.Equal(amount.Mul(decimal.NewFromInt(int64(won)))) {
+		t.Errorf("holds of %s don't match %d reservations of %s", held, won, amount)
+	}
+}
@@ -0,0 +1,112 @@
+package bank
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/drmitchell85/finsys/internal/utils"
+	"github.com/google/uuid"
+	"github.com/shopspring/decimal"
+)
+
+// httpBankService talks to the bank over the wire, see NewHandler for the
+// other end
+type httpBankService struct {
+	client  *http.Client
+	baseURL string
+}
+
+func NewHTTPBankService(client *http.Client, baseURL string) BankService {
+	return &httpBankService{
+		client:  client,
+		baseURL: strings.TrimRight(baseURL, "/"),
+	}
+}
+
+func (h *httpBankService) HasSufficientFunds(ctx context.Context, accountID uuid.UUID, amount decimal.Decimal) (bool, error) {
+	path := fmt.Sprintf("/accounts/%s/balance?amount=%s", accountID, url.QueryEscape(amount.String()))
+
+	var resp balanceResponse
+	err := h.do(ctx, http.MethodGet, path, nil, &resp)
+	if err != nil {
+		return false, err
+	}
+
+	return resp.Sufficient, nil
+}
+
+func (h *httpBankService) ReserveFunds(ctx context.Context, accountID uuid.UUID, amount decimal.Decimal) (uuid.UUID, time.Time, error) {
+	path := fmt.Sprintf("/accounts/%s/reservations", accountID)
+
+	var resp reserveResponse
+	err := h.do(ctx, http.MethodPost, path, reserveRequest{Amount: amount}, &resp)
+	if err != nil {
+		return uuid.Nil, time.Time{}, err
+	}
+
+	return resp.ReservationID, resp.ExpiresAt, nil
+}
+
+func (h *httpBankService) ReleaseFunds(ctx context.Context, accountID uuid.UUID, reservationID uuid.UUID) error {
+	path := fmt.Sprintf("/accounts/%s/reservations/%s/release", accountID, reservationID)
+	return h.do(ctx, http.MethodPost, path, nil, nil)
+}
+
+func (h *httpBankService) CaptureFunds(ctx context.Context, accountID uuid.UUID, reservationID uuid.UUID) error {
+	path := fmt.Sprintf("/accounts/%s/reservations/%s/capture", accountID, reservationID)
+	return h.do(ctx, http.MethodPost, path, nil, nil)
+}
+
+// do sends a request and decodes the response into out. Errors from the bank
+// come back with the code the bank used, so callers can tell a declined
+// reservation from a failed one. Anything that never got an answer is an
+// internal error, which the resilient wrapper treats as retryable.
+func (h *httpBankService) do(ctx context.Context, method string, path string, body any, out any) error {
+	var reqBody io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return utils.NewInternalError(fmt.Errorf("error marshaling bank request: %w", err))
+		}
+		reqBody = bytes.NewReader(data)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, h.baseURL+path, reqBody)
+	if err != nil {
+		return utils.NewInternalError(fmt.Errorf("error building bank request: %w", err))
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := h.client.Do(req)
+	if err != nil {
+		return utils.NewInternalError(fmt.Errorf("error calling bank %s %s: %w", method, path, err))
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 400 {
+		var errResp errorResponse
+		if err := json.NewDecoder(resp.Body).Decode(&errResp); err != nil || errResp.Code == "" {
+			return utils.NewInternalError(fmt.Errorf("bank %s %s responded %d", method, path, resp.StatusCode))
+		}
+		return utils.NewAppError(utils.ErrorCode(errResp.Code), errResp.Message, fmt.Errorf("bank %s %s responded %d", method, path, resp.StatusCode))
+	}
+
+	if out == nil {
+		return nil
+	}
+
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return utils.NewInternalError(fmt.Errorf("error decoding bank response: %w", err))
+	}
+
+	return nil
+}
@@ -0,0 +1,139 @@
+package bank
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/drmitchell85/finsys/internal/config"
+	"github.com/drmitchell85/finsys/internal/utils"
+	"github.com/google/uuid"
+	"golang.org/x/exp/rand"
+)
+
+// operations the mock bank can inject faults into
+const (
+	opBalance = "balance"
+	opReserve = "reserve"
+	opRelease = "release"
+	opCapture = "capture"
+)
+
+// faults a scenario can script
+const (
+	faultError             = "error"
+	faultTimeout           = "timeout"
+	faultInsufficientFunds = "insufficient_funds"
+)
+
+// latency distributions
+const (
+	latencyFixed       = "fixed"
+	latencyUniform     = "uniform"
+	latencyNormal      = "normal"
+	latencyExponential = "exponential"
+)
+
+// faultInjector makes the mock bank behave like a slow, flaky network
+// service. Everything random comes from one seeded source so a run can be
+// replayed exactly.
+type faultInjector struct {
+	config config.MockBankConfig
+
+	mu    sync.Mutex
+	rand  *rand.Rand
+	calls map[string]int // per account and operation, for scripted scenarios
+}
+
+func newFaultInjector(config config.MockBankConfig) *faultInjector {
+	seed := config.Seed
+	if seed == 0 {
+		seed = uint64(time.Now().UnixNano())
+	}
+
+	return &faultInjector{
+		config: config,
+		rand:   rand.New(rand.NewSource(seed)),
+		calls:  make(map[string]int),
+	}
+}
+
+// inject runs before every mock bank call. It sleeps for the simulated
+// latency and returns the fault the call should fail with, if any.
+func (f *faultInjector) inject(ctx context.Context, op string, accountID uuid.UUID) error {
+	fault, latency := f.roll(op, accountID)
+
+	if fault == faultTimeout {
+		// hang until the caller gives up
+		latency = f.config.Hang
+	}
+
+	select {
+	case <-ctx.Done():
+		return utils.NewInternalError(fmt.Errorf("bank %s for %s: %w", op, accountID, ctx.Err()))
+	case <-time.After(latency):
+	}
+
+	switch fault {
+	case faultError, faultTimeout:
+		return utils.NewInternalError(fmt.Errorf("injected %s fault in bank %s for %s", fault, op, accountID))
+	case faultInsufficientFunds:
+		return utils.NewInsufficientFundsError("insufficient funds", fmt.Errorf("injected fault in bank %s for %s", op, accountID))
+	}
+
+	return nil
+}
+
+// roll decides the fault and latency for one call under the lock, so the
+// sequence drawn from the seed doesn't depend on goroutine scheduling
+// within a call
+func (f *faultInjector) roll(op string, accountID uuid.UUID) (string, time.Duration) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	key := accountID.String() + ":" + op
+	f.calls[key]++
+	call := f.calls[key]
+
+	latency := f.latency()
+
+	for _, s := range f.config.Scenarios {
+		if strings.EqualFold(s.Account, accountID.String()) && s.Operation == op && (s.Call == 0 || s.Call == call) {
+			return s.Fault, latency
+		}
+	}
+
+	roll := f.rand.Float64()
+	switch {
+	case roll < f.config.TimeoutRate:
+		return faultTimeout, latency
+	case roll < f.config.TimeoutRate+f.config.ErrorRate:
+		return faultError, latency
+	}
+
+	return "", latency
+}
+
+func (f *faultInjector) latency() time.Duration {
+	l := f.config.Latency
+
+	var d float64
+	switch l.Distribution {
+	case latencyFixed:
+		d = float64(l.Mean)
+	case latencyNormal:
+		d = float64(l.Mean) + f.rand.NormFloat64()*float64(l.StdDev)
+	case latencyExponential:
+		d = f.rand.ExpFloat64() * float64(l.Mean)
+	default:
+		d = float64(l.Min) + f.rand.Float64()*float64(l.Max-l.Min)
+	}
+
+	if l.Max > 0 {
+		d = math.Min(d, float64(l.Max))
+	}
+	return time.Duration(math.Max(d, float64(l.Min)))
+}
@@ -0,0 +1,129 @@
+package bank
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/drmitchell85/finsys/internal/config"
+	"github.com/drmitchell85/finsys/internal/utils"
+	"github.com/google/uuid"
+)
+
+type rolled struct {
+	fault   string
+	latency time.Duration
+}
+
+// rolls draws n reserve calls for one account from a fresh injector
+func rolls(cfg config.MockBankConfig, accountID uuid.UUID, n int) []rolled {
+	f := newFaultInjector(cfg)
+
+	out := make([]rolled, 0, n)
+	for i := 0; i < n; i++ {
+		fault, latency := f.roll(opReserve, accountID)
+		out = append(out, rolled{fault, latency})
+	}
+	return out
+}
+
+func TestSameSeedReplaysFaultsAndLatency(t *testing.T) {
+	accountID := uuid.New()
+
+	tests := []struct {
+		name    string
+		latency config.LatencyConfig
+	}{
+		{"uniform", config.LatencyConfig{Distribution: latencyUniform, Min: time.Millisecond, Max: 50 * time.Millisecond}},
+		{"normal", config.LatencyConfig{Distribution: latencyNormal, Mean: 20 * time.Millisecond, StdDev: 5 * time.Millisecond}},
+		{"exponential", config.LatencyConfig{Distribution: latencyExponential, Mean: 20 * time.Millisecond, Max: time.Second}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := config.MockBankConfig{
+				Seed:        42,
+				Latency:     tt.latency,
+				ErrorRate:   0.2,
+				TimeoutRate: 0.1,
+			}
+
+			first := rolls(cfg, accountID, 200)
+			second := rolls(cfg, accountID, 200)
+
+			faults := 0
+			for i := range first {
+				if first[i] != second[i] {
+					t.Fatalf("call %d: got %+v, then %+v with the same seed", i+1, first[i], second[i])
+				}
+				if first[i].fault != "" {
+					faults++
+				}
+			}
+
+			// make sure the comparison covered both outcomes
+			if faults == 0 || faults == len(first) {
+				t.Fatalf("%d of %d calls faulted, want a mix", faults, len(first))
+			}
+
+			cfg.Seed = 43
+			other := rolls(cfg, accountID, 200)
+			same := true
+			for i := range first {
+				if first[i] != other[i] {
+					same = false
+					break
+				}
+			}
+			if same {
+				t.Fatal("a different seed produced the same sequence")
+			}
+		})
+	}
+}
+
+func TestScriptedScenarioFailsOnlyThatCall(t *testing.T) {
+	accountID := uuid.New()
+	otherID := uuid.New()
+
+	f := newFaultInjector(config.MockBankConfig{
+		Seed:    1,
+		Latency: config.LatencyConfig{Distribution: latencyFixed},
+		Scenarios: []config.BankScenario{
+			{Account: accountID.String(), Operation: opReserve, Call: 3, Fault: faultError},
+		},
+	})
+
+	tests := []struct {
+		name      string
+		op        string
+		accountID uuid.UUID
+		wantErr   bool
+	}{
+		{"first reserve", opReserve, accountID, false},
+		{"second reserve", opReserve, accountID, false},
+		{"release between", opRelease, accountID, false},
+		{"other account", opReserve, otherID, false},
+		{"third reserve", opReserve, accountID, true},
+		{"fourth reserve", opReserve, accountID, false},
+		{"other account again", opReserve, otherID, false},
+		{"other account third", opReserve, otherID, false},
+	}
+
+	// the cases run in order, the scenario counts calls across them
+	for _, tt := range tests {
+		err := f.inject(context.Background(), tt.op, tt.accountID)
+
+		if !tt.wantErr {
+			if err != nil {
+				t.Errorf("%s: unexpected fault %v", tt.name, err)
+			}
+			continue
+		}
+
+		appErr, ok := utils.GetAppError(err)
+		if !ok || appErr.Code != utils.ErrInternal {
+			t.Errorf("%s: want injected internal error, got %v", tt.name, err)
+		}
+	}
+}
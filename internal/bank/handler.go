@@ -0,0 +1,135 @@
+package bank
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/drmitchell85/finsys/internal/utils"
+	"github.com/go-chi/chi"
+	"github.com/google/uuid"
+	"github.com/shopspring/decimal"
+)
+
+// wire types shared by the mock bank server and httpBankService
+
+type balanceResponse struct {
+	Sufficient bool `json:"sufficient"`
+}
+
+type reserveRequest struct {
+	Amount decimal.Decimal `json:"amount"`
+}
+
+type reserveResponse struct {
+	ReservationID uuid.UUID `json:"reservation_id"`
+	ExpiresAt     time.Time `json:"expires_at"`
+}
+
+type errorResponse struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// NewHandler serves a BankService over http, this is what cmd/mockbank runs
+func NewHandler(bs BankService) http.Handler {
+	r := chi.NewRouter()
+
+	r.Get("/accounts/{accountID}/balance", func(w http.ResponseWriter, r *http.Request) {
+		accountID, err := uuid.Parse(chi.URLParam(r, "accountID"))
+		if err != nil {
+			writeError(w, utils.NewValidationError("invalid account id", err))
+			return
+		}
+
+		amount, err := decimal.NewFromString(r.URL.Query().Get("amount"))
+		if err != nil {
+			writeError(w, utils.NewValidationError("invalid amount", err))
+			return
+		}
+
+		ok, err := bs.HasSufficientFunds(r.Context(), accountID, amount)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+
+		writeJSON(w, http.StatusOK, balanceResponse{Sufficient: ok})
+	})
+
+	r.Post("/accounts/{accountID}/reservations", func(w http.ResponseWriter, r *http.Request) {
+		accountID, err := uuid.Parse(chi.URLParam(r, "accountID"))
+		if err != nil {
+			writeError(w, utils.NewValidationError("invalid account id", err))
+			return
+		}
+
+		var req reserveRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeError(w, utils.NewValidationError("invalid request body", err))
+			return
+		}
+
+		resID, expiresAt, err := bs.ReserveFunds(r.Context(), accountID, req.Amount)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+
+		writeJSON(w, http.StatusCreated, reserveResponse{ReservationID: resID, ExpiresAt: expiresAt})
+	})
+
+	r.Post("/accounts/{accountID}/reservations/{reservationID}/release", reservationHandler(bs.ReleaseFunds))
+	r.Post("/accounts/{accountID}/reservations/{reservationID}/capture", reservationHandler(bs.CaptureFunds))
+
+	return r
+}
+
+// reservationHandler serves the calls that act on an existing reservation
+func reservationHandler(fn func(ctx context.Context, accountID uuid.UUID, reservationID uuid.UUID) error) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		accountID, err := uuid.Parse(chi.URLParam(r, "accountID"))
+		if err != nil {
+			writeError(w, utils.NewValidationError("invalid account id", err))
+			return
+		}
+
+		reservationID, err := uuid.Parse(chi.URLParam(r, "reservationID"))
+		if err != nil {
+			writeError(w, utils.NewValidationError("invalid reservation id", err))
+			return
+		}
+
+		if err := fn(r.Context(), accountID, reservationID); err != nil {
+			writeError(w, err)
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func writeJSON(w http.ResponseWriter, code int, payload any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(payload)
+}
+
+func writeError(w http.ResponseWriter, err error) {
+	appErr, ok := utils.GetAppError(err)
+	if !ok {
+		appErr = utils.NewInternalError(err)
+	}
+
+	code := utils.HTTPStatus(appErr.Code)
+	if code == http.StatusInternalServerError {
+		log.Printf("ERROR: %v", err)
+	}
+
+	writeJSON(w, code, errorResponse{
+		Code:    string(appErr.Code),
+		Message: appErr.Message,
+	})
+}
@@ -0,0 +1,210 @@
+package bank
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/drmitchell85/finsys/internal/config"
+	"github.com/drmitchell85/finsys/internal/utils"
+	"github.com/google/uuid"
+	"github.com/shopspring/decimal"
+)
+
+// ErrCircuitOpen means the call was never made, so it's safe to send it to
+// another provider
+var ErrCircuitOpen = errors.New("circuit breaker open")
+
+type breakerState int
+
+const (
+	breakerClosed breakerState = iota
+	breakerOpen
+	breakerHalfOpen
+)
+
+func (s breakerState) String() string {
+	switch s {
+	case breakerOpen:
+		return "open"
+	case breakerHalfOpen:
+		return "half-open"
+	default:
+		return "closed"
+	}
+}
+
+// breaker opens after enough consecutive upstream failures. Once the cooldown
+// passes it lets a few trial calls through, closing again if they succeed and
+// reopening on the first failure.
+type breaker struct {
+	mu       sync.Mutex
+	config   config.BreakerConfig
+	state    breakerState
+	failures int
+	openedAt time.Time
+	trials   int // calls let through while half-open
+}
+
+func (b *breaker) allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case breakerOpen:
+		if time.Since(b.openedAt) < b.config.OpenTimeout {
+			return false
+		}
+		b.setState(breakerHalfOpen)
+		b.trials = 0
+		fallthrough
+	case breakerHalfOpen:
+		if b.trials >= b.config.HalfOpenRequests {
+			return false
+		}
+		b.trials++
+	}
+
+	return true
+}
+
+// available is false while open and cooling down
+func (b *breaker) available() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.state != breakerOpen || time.Since(b.openedAt) >= b.config.OpenTimeout
+}
+
+func (b *breaker) record(err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if err == nil || !utils.IsTransient(err) {
+		// the bank answered, even if the answer was no
+		b.failures = 0
+		if b.state == breakerHalfOpen {
+			b.setState(breakerClosed)
+		}
+		return
+	}
+
+	b.failures++
+	if b.state == breakerHalfOpen || b.failures >= b.config.FailureThreshold {
+		b.setState(breakerOpen)
+		b.openedAt = time.Now()
+	}
+}
+
+func (b *breaker) setState(state breakerState) {
+	if b.state != state {
+		log.Printf("WARN: bank circuit breaker %s -> %s", b.state, state)
+	}
+	b.state = state
+}
+
+// resilientBankService guards another BankService with per-call timeouts,
+// retries for transient failures and a circuit breaker
+type resilientBankService struct {
+	bs      BankService
+	config  config.BankConfig
+	breaker *breaker
+}
+
+func NewResilientBankService(bs BankService, config config.BankConfig) BankService {
+	return &resilientBankService{
+		bs:      bs,
+		config:  config,
+		breaker: &breaker{config: config.Breaker},
+	}
+}
+
+// Available reports whether the breaker would let a call through, the router
+// uses it to fail over
+func (r *resilientBankService) Available() bool {
+	return r.breaker.available()
+}
+
+func (r *resilientBankService) HasSufficientFunds(ctx context.Context, accountID uuid.UUID, amount decimal.Decimal) (bool, error) {
+	var ok bool
+	err := r.call(ctx, "has sufficient funds", true, func(ctx context.Context) error {
+		var err error
+		ok, err = r.bs.HasSufficientFunds(ctx, accountID, amount)
+		return err
+	})
+	return ok, err
+}
+
+// ReserveFunds is never retried. a timed out reserve may still have placed
+// the hold, and a second attempt would place another one
+func (r *resilientBankService) ReserveFunds(ctx context.Context, accountID uuid.UUID, amount decimal.Decimal) (uuid.UUID, time.Time, error) {
+	var resID uuid.UUID
+	var expiresAt time.Time
+	err := r.call(ctx, "reserve funds", false, func(ctx context.Context) error {
+		var err error
+		resID, expiresAt, err = r.bs.ReserveFunds(ctx, accountID, amount)
+		return err
+	})
+	return resID, expiresAt, err
+}
+
+func (r *resilientBankService) ReleaseFunds(ctx context.Context, accountID uuid.UUID, reservationID uuid.UUID) error {
+	return r.call(ctx, "release funds", true, func(ctx context.Context) error {
+		return r.bs.ReleaseFunds(ctx, accountID, reservationID)
+	})
+}
+
+func (r *resilientBankService) CaptureFunds(ctx context.Context, accountID uuid.UUID, reservationID uuid.UUID) error {
+	return r.call(ctx, "capture funds", true, func(ctx context.Context) error {
+		return r.bs.CaptureFunds(ctx, accountID, reservationID)
+	})
+}
+
+// call runs fn through the breaker with a timeout per attempt. idempotent
+// calls are retried on transient errors with exponential backoff.
+func (r *resilientBankService) call(ctx context.Context, op string, idempotent bool, fn func(ctx context.Context) error) error {
+	attempts := 1
+	if idempotent {
+		attempts += r.config.MaxRetries
+	}
+	backoff := r.config.RetryBackoff
+
+	var err error
+	for attempt := 1; attempt <= attempts; attempt++ {
+		if !r.breaker.allow() {
+			return utils.NewUpstreamUnavailableError("bank is unavailable, try again later", fmt.Errorf("%s: %w", op, ErrCircuitOpen))
+		}
+
+		err = r.attempt(ctx, fn)
+		r.breaker.record(err)
+		if err == nil || !utils.IsTransient(err) || attempt == attempts {
+			break
+		}
+
+		log.Printf("WARN: bank %s failed, attempt %d of %d: %v", op, attempt, attempts, err)
+
+		select {
+		case <-ctx.Done():
+			return utils.NewInternalError(ctx.Err())
+		case <-time.After(backoff):
+		}
+		backoff = min(backoff*2, r.config.MaxBackoff)
+	}
+
+	return err
+}
+
+func (r *resilientBankService) attempt(ctx context.Context, fn func(ctx context.Context) error) error {
+	ctx, cancel := context.WithTimeout(ctx, r.config.Timeout)
+	defer cancel()
+
+	err := fn(ctx)
+	if err != nil && errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return utils.NewUpstreamUnavailableError("bank timed out, try again later", fmt.Errorf("bank call exceeded %s: %w", r.config.Timeout, err))
+	}
+
+	return err
+}
@@ -0,0 +1,249 @@
+package bank
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/drmitchell85/finsys/internal/config"
+	"github.com/drmitchell85/finsys/internal/utils"
+	"github.com/google/uuid"
+	"github.com/shopspring/decimal"
+)
+
+// stubBank answers every call with err, or blocks until the caller gives up
+// when hang is set, counting calls per operation
+type stubBank struct {
+	mu    sync.Mutex
+	err   error
+	hang  bool
+	calls map[string]int
+}
+
+func (s *stubBank) do(ctx context.Context, op string) error {
+	s.mu.Lock()
+	if s.calls == nil {
+		s.calls = make(map[string]int)
+	}
+	s.calls[op]++
+	err, hang := s.err, s.hang
+	s.mu.Unlock()
+
+	if hang {
+		<-ctx.Done()
+		return utils.NewInternalError(ctx.Err())
+	}
+	return err
+}
+
+func (s *stubBank) count(op string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.calls[op]
+}
+
+func (s *stubBank) fail(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.err = err
+}
+
+func (s *stubBank) HasSufficientFunds(ctx context.Context, accountID uuid.UUID, amount decimal.Decimal) (bool, error) {
+	return true, s.do(ctx, opBalance)
+}
+
+func (s *stubBank) ReserveFunds(ctx context.Context, accountID uuid.UUID, amount decimal.Decimal) (uuid.UUID, time.Time, error) {
+	return uuid.New(), time.Now().Add(time.Hour), s.do(ctx, opReserve)
+}
+
+func (s *stubBank) ReleaseFunds(ctx context.Context, accountID uuid.UUID, reservationID uuid.UUID) error {
+	return s.do(ctx, opRelease)
+}
+
+func (s *stubBank) CaptureFunds(ctx context.Context, accountID uuid.UUID, reservationID uuid.UUID) error {
+	return s.do(ctx, opCapture)
+}
+
+var errUpstream = utils.NewInternalError(errors.New("connection reset"))
+
+func testBankConfig() config.BankConfig {
+	return config.BankConfig{
+		Timeout:      time.Second,
+		RetryBackoff: time.Millisecond,
+		MaxBackoff:   time.Millisecond,
+		Breaker: config.BreakerConfig{
+			FailureThreshold: 2,
+			OpenTimeout:      20 * time.Millisecond,
+			HalfOpenRequests: 1,
+		},
+	}
+}
+
+func TestBreakerTransitions(t *testing.T) {
+	b := &breaker{config: testBankConfig().Breaker}
+
+	steps := []struct {
+		name      string
+		wait      time.Duration
+		err       error // recorded after the call when it's allowed
+		wantAllow bool
+		wantState breakerState
+	}{
+		{"first failure", 0, errUpstream, true, breakerClosed},
+		{"threshold reached", 0, errUpstream, true, breakerOpen},
+		{"open rejects", 0, nil, false, breakerOpen},
+		{"cooled down trial fails", 25 * time.Millisecond, errUpstream, true, breakerOpen},
+		{"reopened rejects", 0, nil, false, breakerOpen},
+		{"cooled down trial succeeds", 25 * time.Millisecond, nil, true, breakerClosed},
+		{"closed again", 0, nil, true, breakerClosed},
+		{"refusal isn't a failure", 0, utils.NewInsufficientFundsError("insufficient funds", nil), true, breakerClosed},
+		{"count restarted", 0, errUpstream, true, breakerClosed},
+	}
+
+	for _, step := range steps {
+		time.Sleep(step.wait)
+
+		allowed := b.allow()
+		if allowed != step.wantAllow {
+			t.Fatalf("%s: allow = %v, want %v", step.name, allowed, step.wantAllow)
+		}
+		if allowed {
+			b.record(step.err)
+		}
+		if b.state != step.wantState {
+			t.Fatalf("%s: state %s, want %s", step.name, b.state, step.wantState)
+		}
+	}
+}
+
+func TestBreakerLimitsHalfOpenTrials(t *testing.T) {
+	b := &breaker{config: testBankConfig().Breaker}
+	b.record(errUpstream)
+	b.record(errUpstream)
+
+	time.Sleep(25 * time.Millisecond)
+
+	if !b.allow() {
+		t.Fatal("first trial after cooldown rejected")
+	}
+	if b.state != breakerHalfOpen {
+		t.Fatalf("state %s during trial, want half-open", b.state)
+	}
+	if b.allow() {
+		t.Fatal("second trial let through with one allowed")
+	}
+}
+
+func TestOpenBreakerSkipsBank(t *testing.T) {
+	stub := &stubBank{err: errUpstream}
+	bs := NewResilientBankService(stub, testBankConfig())
+	ctx := context.Background()
+
+	for i := 0; i < 2; i++ {
+		bs.ReleaseFunds(ctx, uuid.New(), uuid.New())
+	}
+
+	err := bs.ReleaseFunds(ctx, uuid.New(), uuid.New())
+	if !errors.Is(err, ErrCircuitOpen) {
+		t.Fatalf("want ErrCircuitOpen, got %v", err)
+	}
+	if appErr, ok := utils.GetAppError(err); !ok || appErr.Code != utils.ErrUpstreamUnavailable {
+		t.Fatalf("want upstream unavailable, got %v", err)
+	}
+	if n := stub.count(opRelease); n != 2 {
+		t.Fatalf("bank called %d times, want 2", n)
+	}
+
+	// recovers once the cooldown passes and the bank answers
+	stub.fail(nil)
+	time.Sleep(25 * time.Millisecond)
+
+	if err := bs.ReleaseFunds(ctx, uuid.New(), uuid.New()); err != nil {
+		t.Fatalf("trial call failed: %v", err)
+	}
+	if !bs.(*resilientBankService).Available() {
+		t.Fatal("breaker not closed after a successful trial")
+	}
+}
+
+func TestReserveIsNeverRetried(t *testing.T) {
+	cfg := testBankConfig()
+	cfg.MaxRetries = 3
+	cfg.Breaker.FailureThreshold = 100
+
+	tests := []struct {
+		name string
+		op   string
+		call func(bs BankService) error
+		want int
+	}{
+		{"reserve", opReserve, func(bs BankService) error {
+			_, _, err := bs.ReserveFunds(context.Background(), uuid.New(), decimal.NewFromInt(1))
+			return err
+		}, 1},
+		{"release", opRelease, func(bs BankService) error {
+			return bs.ReleaseFunds(context.Background(), uuid.New(), uuid.New())
+		}, 4},
+		{"capture", opCapture, func(bs BankService) error {
+			return bs.CaptureFunds(context.Background(), uuid.New(), uuid.New())
+		}, 4},
+		{"balance", opBalance, func(bs BankService) error {
+			_, err := bs.HasSufficientFunds(context.Background(), uuid.New(), decimal.NewFromInt(1))
+			return err
+		}, 4},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stub := &stubBank{err: errUpstream}
+			bs := NewResilientBankService(stub, cfg)
+
+			if err := tt.call(bs); err == nil {
+				t.Fatal("want the upstream error")
+			}
+			if n := stub.count(tt.op); n != tt.want {
+				t.Fatalf("bank called %d times, want %d", n, tt.want)
+			}
+		})
+	}
+}
+
+func TestNonTransientErrorsAreNotRetried(t *testing.T) {
+	cfg := testBankConfig()
+	cfg.MaxRetries = 3
+
+	stub := &stubBank{err: utils.NewReservationCapturedError("reservation already captured", fmt.Errorf("captured"))}
+	bs := NewResilientBankService(stub, cfg)
+
+	err := bs.ReleaseFunds(context.Background(), uuid.New(), uuid.New())
+	if appErr, ok := utils.GetAppError(err); !ok || appErr.Code != utils.ErrReservationCaptured {
+		t.Fatalf("want the bank's answer back, got %v", err)
+	}
+	if n := stub.count(opRelease); n != 1 {
+		t.Fatalf("bank called %d times, want 1", n)
+	}
+}
+
+func TestTimeoutIsUpstreamUnavailable(t *testing.T) {
+	cfg := testBankConfig()
+	cfg.Timeout = 10 * time.Millisecond
+
+	stub := &stubBank{hang: true}
+	bs := NewResilientBankService(stub, cfg)
+
+	start := time.Now()
+	_, _, err := bs.ReserveFunds(context.Background(), uuid.New(), decimal.NewFromInt(1))
+
+	if appErr, ok := utils.GetAppError(err); !ok || appErr.Code != utils.ErrUpstreamUnavailable {
+		t.Fatalf("want upstream unavailable, got %v", err)
+	}
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("want the deadline kept in the chain, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("call took %s, want it cut off after %s", elapsed, cfg.Timeout)
+	}
+}
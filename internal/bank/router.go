@@ -0,0 +1,177 @@
+package bank
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/drmitchell85/finsys/internal/config"
+	"github.com/drmitchell85/finsys/internal/utils"
+	"github.com/shopspring/decimal"
+)
+
+// defaultProvider names the single provider built from bank.backend when no
+// providers are configured
+const defaultProvider = "mockbank"
+
+// Provider is a payment provider and the transactions it accepts
+type Provider struct {
+	Name string
+	BankService
+
+	currencies map[string]bool // empty accepts any
+	minAmount  *decimal.Decimal
+	maxAmount  *decimal.Decimal
+	priority   int
+
+	webhookSecret    string
+	webhookTolerance time.Duration
+}
+
+func (p *Provider) accepts(currency string, amount decimal.Decimal) bool {
+	if len(p.currencies) > 0 && !p.currencies[strings.ToUpper(currency)] {
+		return false
+	}
+	if p.minAmount != nil && amount.LessThan(*p.minAmount) {
+		return false
+	}
+	if p.maxAmount != nil && amount.GreaterThan(*p.maxAmount) {
+		return false
+	}
+	return true
+}
+
+// available is false while the provider's circuit breaker is open
+func (p *Provider) available() bool {
+	if h, ok := p.BankService.(interface{ Available() bool }); ok {
+		return h.Available()
+	}
+	return true
+}
+
+type Router interface {
+	// Route lists the providers that can take a transaction, best first.
+	// Providers whose breaker is open are left out, the rest are the failover.
+	Route(currency string, amount decimal.Decimal) ([]*Provider, error)
+	// Provider looks up the provider a transaction was placed with
+	Provider(name string) (*Provider, error)
+}
+
+type providerRouter struct {
+	providers []*Provider // in priority order
+}
+
+// NewRouter builds every configured provider, each behind its own timeouts,
+// retries and circuit breaker
+func NewRouter(cfg config.Config, db *sql.DB, client *http.Client) (Router, error) {
+	providerConfigs := cfg.Bank.Providers
+	if len(providerConfigs) == 0 {
+		providerConfigs = []config.ProviderConfig{{
+			Name:          defaultProvider,
+			Backend:       cfg.Bank.Backend,
+			URL:           cfg.Bank.URL,
+			WebhookSecret: cfg.Bank.WebhookSecret,
+		}}
+	}
+
+	router := &providerRouter{}
+	for _, pc := range providerConfigs {
+		provider, err := newProvider(pc, cfg, db, client)
+		if err != nil {
+			return nil, err
+		}
+		router.providers = append(router.providers, provider)
+	}
+
+	// stable, so equal priorities keep their config order
+	slices.SortStableFunc(router.providers, func(a, b *Provider) int {
+		return a.priority - b.priority
+	})
+
+	return router, nil
+}
+
+func newProvider(pc config.ProviderConfig, cfg config.Config, db *sql.DB, client *http.Client) (*Provider, error) {
+	var backend BankService
+	switch pc.Backend {
+	case "", "db":
+		backend = NewBankService(db, cfg.Bank.Mock)
+	case "http":
+		backend = NewHTTPBankService(client, pc.URL)
+	default:
+		return nil, fmt.Errorf("unknown backend %q for provider %s", pc.Backend, pc.Name)
+	}
+
+	provider := &Provider{
+		Name:        pc.Name,
+		BankService: NewResilientBankService(backend, cfg.Bank),
+		currencies:  make(map[string]bool),
+		priority:    pc.Priority,
+
+		webhookSecret:    pc.WebhookSecret,
+		webhookTolerance: cfg.Bank.WebhookTolerance,
+	}
+
+	for _, c := range pc.Currencies {
+		provider.currencies[strings.ToUpper(c)] = true
+	}
+
+	if pc.MinAmount != "" {
+		min, err := decimal.NewFromString(pc.MinAmount)
+		if err != nil {
+			return nil, fmt.Errorf("invalid minAmount for provider %s: %w", pc.Name, err)
+		}
+		provider.minAmount = &min
+	}
+
+	if pc.MaxAmount != "" {
+		max, err := decimal.NewFromString(pc.MaxAmount)
+		if err != nil {
+			return nil, fmt.Errorf("invalid maxAmount for provider %s: %w", pc.Name, err)
+		}
+		provider.maxAmount = &max
+	}
+
+	return provider, nil
+}
+
+func (r *providerRouter) Route(currency string, amount decimal.Decimal) ([]*Provider, error) {
+	var eligible, available []*Provider
+	for _, p := range r.providers {
+		if !p.accepts(currency, amount) {
+			continue
+		}
+		eligible = append(eligible, p)
+		if p.available() {
+			available = append(available, p)
+		}
+	}
+
+	if len(eligible) == 0 {
+		return nil, utils.NewValidationError(fmt.Sprintf("no payment provider accepts %s %s", amount, currency), fmt.Errorf("no provider for %s %s", amount, currency))
+	}
+	if len(available) == 0 {
+		return nil, utils.NewUpstreamUnavailableError("bank is unavailable, try again later", fmt.Errorf("every provider for %s is unavailable", currency))
+	}
+
+	return available, nil
+}
+
+// Provider with an empty name is the highest priority provider, which is
+// where transactions from before provider routing were placed
+func (r *providerRouter) Provider(name string) (*Provider, error) {
+	if name == "" {
+		return r.providers[0], nil
+	}
+
+	for _, p := range r.providers {
+		if p.Name == name {
+			return p, nil
+		}
+	}
+
+	return nil, utils.NewInternalError(fmt.Errorf("unknown payment provider %q", name))
+}
@@ -0,0 +1,172 @@
+package bank
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/drmitchell85/finsys/internal/utils"
+	"github.com/google/uuid"
+)
+
+// HeaderWebhookSignature carries "t=<unix seconds>,v1=<hex hmac-sha256>",
+// signed over "<t>.<body>" with the provider's webhook secret
+const HeaderWebhookSignature = "X-Provider-Signature"
+
+// events a provider sends about a reservation
+const (
+	EventReservationCaptured = "reservation.captured"
+	EventReservationReleased = "reservation.released"
+	EventReservationExpired  = "reservation.expired"
+)
+
+// WebhookEvent is what providers post to /webhooks/provider/{name}
+type WebhookEvent struct {
+	ID            string    `json:"id"` // unique per provider, used to drop redeliveries
+	Type          string    `json:"type"`
+	ReservationID uuid.UUID `json:"reservation_id"`
+	AccountID     uuid.UUID `json:"account_id"`
+	CreatedAt     time.Time `json:"created_at"`
+}
+
+// SignWebhook builds the signature header value for a webhook body
+func SignWebhook(secret string, timestamp int64, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(mac, "%d.", timestamp)
+	mac.Write(body)
+
+	return fmt.Sprintf("t=%d,v1=%s", timestamp, hex.EncodeToString(mac.Sum(nil)))
+}
+
+// VerifyWebhook checks a webhook was signed by the provider within the
+// tolerance, so an old captured callback can't be replayed later
+func (p *Provider) VerifyWebhook(signature string, body []byte) error {
+	if p.webhookSecret == "" {
+		return utils.NewUnauthorizedError("webhooks not enabled for provider", fmt.Errorf("no webhook secret for provider %s", p.Name))
+	}
+
+	var timestamp int64
+	var sig string
+	for _, part := range strings.Split(signature, ",") {
+		k, v, _ := strings.Cut(part, "=")
+		switch k {
+		case "t":
+			timestamp, _ = strconv.ParseInt(v, 10, 64)
+		case "v1":
+			sig = v
+		}
+	}
+	if timestamp == 0 || sig == "" {
+		return utils.NewUnauthorizedError("invalid webhook signature", fmt.Errorf("malformed %s header", HeaderWebhookSignature))
+	}
+
+	age := time.Since(time.Unix(timestamp, 0))
+	if age > p.webhookTolerance || age < -p.webhookTolerance {
+		return utils.NewUnauthorizedError("webhook timestamp outside tolerance", fmt.Errorf("webhook from %s is %s old", p.Name, age))
+	}
+
+	expected := SignWebhook(p.webhookSecret, timestamp, body)
+	if !hmac.Equal([]byte(expected), []byte(fmt.Sprintf("t=%d,v1=%s", timestamp, sig))) {
+		return utils.NewUnauthorizedError("invalid webhook signature", fmt.Errorf("signature mismatch for provider %s", p.Name))
+	}
+
+	return nil
+}
+
+// webhookAttempts bounds delivery of one event before the emitter gives up
+const webhookAttempts = 5
+
+// webhookEmitter posts a callback after every capture and release, the way
+// a real provider confirms settlement asynchronously. Reserve and balance
+// checks don't call back.
+type webhookEmitter struct {
+	BankService
+	client *http.Client
+	url    string
+	secret string
+}
+
+// NewWebhookEmitter wraps the mock bank so it calls back to url. Delivery
+// happens in the background and is retried, so callers never wait on it.
+func NewWebhookEmitter(bs BankService, client *http.Client, url string, secret string) BankService {
+	return &webhookEmitter{
+		BankService: bs,
+		client:      client,
+		url:         url,
+		secret:      secret,
+	}
+}
+
+func (e *webhookEmitter) ReleaseFunds(ctx context.Context, accountID uuid.UUID, reservationID uuid.UUID) error {
+	err := e.BankService.ReleaseFunds(ctx, accountID, reservationID)
+	if err == nil {
+		e.emit(EventReservationReleased, accountID, reservationID)
+	}
+	return err
+}
+
+func (e *webhookEmitter) CaptureFunds(ctx context.Context, accountID uuid.UUID, reservationID uuid.UUID) error {
+	err := e.BankService.CaptureFunds(ctx, accountID, reservationID)
+	if err == nil {
+		e.emit(EventReservationCaptured, accountID, reservationID)
+	}
+	return err
+}
+
+func (e *webhookEmitter) emit(eventType string, accountID uuid.UUID, reservationID uuid.UUID) {
+	body, err := json.Marshal(WebhookEvent{
+		ID:            "evt_" + uuid.NewString(),
+		Type:          eventType,
+		ReservationID: reservationID,
+		AccountID:     accountID,
+		CreatedAt:     time.Now().UTC(),
+	})
+	if err != nil {
+		log.Printf("ERROR: error marshaling webhook: %v", err)
+		return
+	}
+
+	go func() {
+		backoff := time.Second
+		for attempt := 1; attempt <= webhookAttempts; attempt++ {
+			err := e.deliver(body)
+			if err == nil {
+				return
+			}
+
+			log.Printf("WARN: webhook %s for %s failed, attempt %d of %d: %v", eventType, reservationID, attempt, webhookAttempts, err)
+			time.Sleep(backoff)
+			backoff *= 2
+		}
+	}()
+}
+
+func (e *webhookEmitter) deliver(body []byte) error {
+	req, err := http.NewRequest(http.MethodPost, e.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(HeaderWebhookSignature, SignWebhook(e.secret, time.Now().Unix(), body))
+
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("callback responded %d", resp.StatusCode)
+	}
+
+	return nil
+}
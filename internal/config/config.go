@@ -2,18 +2,28 @@ package config
 
 import (
 	"fmt"
+	"os"
+	"regexp"
 	"strings"
+	"time"
 
 	"github.com/spf13/viper"
 )
 
 type Config struct {
-	App      AppConfig      `mapstructure:"app"`
-	Server   ServerConfig   `mapstructure:"server"`
-	Database DatabaseConfig `mapstructure:"database"`
-	Redis    RedisConfig    `mapstructure:"redis"`
-	SQS      SQSConfig      `mapstructure:"sqs"`
-	AWS      AWSConfig      `mapstructure:"aws"`
+	App         AppConfig         `mapstructure:"app"`
+	Server      ServerConfig      `mapstructure:"server"`
+	Database    DatabaseConfig    `mapstructure:"database"`
+	Redis       RedisConfig       `mapstructure:"redis"`
+	SQS         SQSConfig         `mapstructure:"sqs"`
+	AWS         AWSConfig         `mapstructure:"aws"`
+	Outbox      OutboxConfig      `mapstructure:"outbox"`
+	Sweeper     SweeperConfig     `mapstructure:"sweeper"`
+	Auth        AuthConfig        `mapstructure:"auth"`
+	RateLimit   RateLimitConfig   `mapstructure:"rateLimit"`
+	Lock        LockConfig        `mapstructure:"lock"`
+	Idempotency IdempotencyConfig `mapstructure:"idempotency"`
+	Bank        BankConfig        `mapstructure:"bank"`
 }
 
 type AppConfig struct {
@@ -34,17 +44,21 @@ type DatabaseConfig struct {
 }
 
 type RedisConfig struct {
-	Host string `mapstructure:"host"`
-	Port int    `mapstructure:"port"`
+	Host           string        `mapstructure:"host"`
+	Port           int           `mapstructure:"port"`
+	HealthInterval time.Duration `mapstructure:"healthInterval"` // how often a down cache is retried
 }
 
 type SQSConfig struct {
-	TransactionQueue    string `mapstructure:"transactionQueue"`
-	TransactionDLQ      string `mapstructure:"transactionDLQ"`
-	NotificationQueue   string `mapstructure:"notificationQueue"`
-	NotificationDLQ     string `mapstructure:"notificationDLQ"`
-	MaxNumberOfMessages int    `mapstructure:"maxNumberOfMessages"`
-	WaitTimeSeconds     int    `mapstructure:"waitTimeSeconds"`
+	Backend             string        `mapstructure:"backend"` // sqs, postgres or memory
+	TransactionQueue    string        `mapstructure:"transactionQueue"`
+	TransactionDLQ      string        `mapstructure:"transactionDLQ"`
+	NotificationQueue   string        `mapstructure:"notificationQueue"`
+	NotificationDLQ     string        `mapstructure:"notificationDLQ"`
+	MaxNumberOfMessages int           `mapstructure:"maxNumberOfMessages"`
+	WaitTimeSeconds     int           `mapstructure:"waitTimeSeconds"`
+	VisibilityTimeout   time.Duration `mapstructure:"visibilityTimeout"` // postgres and memory only, sqs uses the queue setting
+	MaxReceiveCount     int           `mapstructure:"maxReceiveCount"`   // postgres and memory only, sqs uses the redrive policy
 }
 
 type AWSConfig struct {
@@ -52,6 +66,136 @@ type AWSConfig struct {
 	Region string `mapstructure:"region"`
 }
 
+type OutboxConfig struct {
+	PollInterval time.Duration `mapstructure:"pollInterval"`
+	BatchSize    int           `mapstructure:"batchSize"`
+	Lease        time.Duration `mapstructure:"lease"`      // how long a claimed batch is hidden from other relays
+	MaxBackoff   time.Duration `mapstructure:"maxBackoff"` // cap on the retry delay after failed publishes
+}
+
+type SweeperConfig struct {
+	Enabled    bool          `mapstructure:"enabled"`
+	Interval   time.Duration `mapstructure:"interval"`
+	BatchSize  int           `mapstructure:"batchSize"`
+	RetryAfter time.Duration `mapstructure:"retryAfter"` // wait before retrying a transaction that failed to expire
+}
+
+type AuthConfig struct {
+	HMAC HMACConfig `mapstructure:"hmac"`
+}
+
+type HMACConfig struct {
+	ReplayWindow time.Duration `mapstructure:"replayWindow"` // max clock skew, and how long signatures are remembered
+	Clients      []HMACClient  `mapstructure:"clients"`
+}
+
+// HMACClient is an internal service allowed to sign requests instead of
+// holding an api key
+type HMACClient struct {
+	ID        string   `mapstructure:"id"`
+	Secret    string   `mapstructure:"secret"`
+	SecretEnv string   `mapstructure:"secretEnv"` // env var to read the secret from, instead of secret
+	UserID    string   `mapstructure:"userId"`    // the user the client acts as
+	Scopes    []string `mapstructure:"scopes"`
+}
+
+type RateLimitConfig struct {
+	Enabled    bool                 `mapstructure:"enabled"`
+	FailOpen   bool                 `mapstructure:"failOpen"`   // allow requests while redis is down, or reject with 503
+	PerKey     RateLimit            `mapstructure:"perKey"`     // every request from one api key or hmac client
+	PerAccount RateLimit            `mapstructure:"perAccount"` // money movement out of one from_account_id by one caller
+	Routes     map[string]RateLimit `mapstructure:"routes"`     // per caller, keyed by route name
+}
+
+type LockConfig struct {
+	TTL  time.Duration `mapstructure:"ttl"`  // renewed while held, only matters if the holder dies
+	Wait time.Duration `mapstructure:"wait"` // how long a request queues behind another on the same account
+}
+
+type IdempotencyConfig struct {
+	TTL            time.Duration `mapstructure:"ttl"`            // how long results are replayed from the cache
+	KeyPrefix      string        `mapstructure:"keyPrefix"`      // redis key prefix, ahead of the client namespace
+	MaxKeyLength   int           `mapstructure:"maxKeyLength"`   // bounded by the transactions column
+	AllowedCharset string        `mapstructure:"allowedCharset"` // regexp character class, without the brackets
+	InFlightTTL    time.Duration `mapstructure:"inFlightTTL"`    // how long a crashed request can block its key
+	InFlightWait   time.Duration `mapstructure:"inFlightWait"`   // how long a duplicate waits for the first result
+}
+
+type BankConfig struct {
+	Backend      string           `mapstructure:"backend"`      // db reads the mock bank tables, http calls cmd/mockbank
+	URL          string           `mapstructure:"url"`          // mock bank base url, for the http backend
+	Timeout      time.Duration    `mapstructure:"timeout"`      // per attempt
+	MaxRetries   int              `mapstructure:"maxRetries"`   // on top of the first attempt, idempotent calls only
+	RetryBackoff time.Duration    `mapstructure:"retryBackoff"` // doubled after every retry
+	MaxBackoff   time.Duration    `mapstructure:"maxBackoff"`
+	Breaker      BreakerConfig    `mapstructure:"breaker"`
+	Mock         MockBankConfig   `mapstructure:"mock"`
+	Providers    []ProviderConfig `mapstructure:"providers"` // when empty, one provider from backend and url
+
+	// webhooks from the provider built from backend and url
+	WebhookSecret    string        `mapstructure:"webhookSecret"`
+	WebhookSecretEnv string        `mapstructure:"webhookSecretEnv"`
+	WebhookTolerance time.Duration `mapstructure:"webhookTolerance"` // max age of a signed webhook, for every provider
+	WebhookDedupTTL  time.Duration `mapstructure:"webhookDedupTTL"`  // how long a delivery being applied holds off redeliveries of its event
+}
+
+// ProviderConfig is one payment provider and the transactions it accepts
+type ProviderConfig struct {
+	Name       string   `mapstructure:"name"`
+	Backend    string   `mapstructure:"backend"` // db or http
+	URL        string   `mapstructure:"url"`
+	Currencies []string `mapstructure:"currencies"` // empty accepts any
+	MinAmount  string   `mapstructure:"minAmount"`  // decimal, empty for no bound
+	MaxAmount  string   `mapstructure:"maxAmount"`
+	Priority   int      `mapstructure:"priority"` // lower is tried first
+
+	WebhookSecret    string `mapstructure:"webhookSecret"` // verifies /webhooks/provider/{name}
+	WebhookSecretEnv string `mapstructure:"webhookSecretEnv"`
+}
+
+type BreakerConfig struct {
+	FailureThreshold int           `mapstructure:"failureThreshold"` // consecutive failures before opening
+	OpenTimeout      time.Duration `mapstructure:"openTimeout"`      // how long to stay open before trying again
+	HalfOpenRequests int           `mapstructure:"halfOpenRequests"` // trial calls allowed while half-open
+}
+
+// MockBankConfig simulates the network between us and the bank
+type MockBankConfig struct {
+	Port        int            `mapstructure:"port"` // cmd/mockbank listens here
+	Seed        uint64         `mapstructure:"seed"` // fixes latency and failure rolls, 0 picks one at random
+	Latency     LatencyConfig  `mapstructure:"latency"`
+	ErrorRate   float64        `mapstructure:"errorRate"`   // share of calls failing with an internal error
+	TimeoutRate float64        `mapstructure:"timeoutRate"` // share of calls hanging for hang
+	Hang        time.Duration  `mapstructure:"hang"`        // how long a timed out call blocks, unless cancelled first
+	Scenarios   []BankScenario `mapstructure:"scenarios"`
+
+	// where cmd/mockbank calls back after capture and release, empty disables
+	WebhookURL       string `mapstructure:"webhookURL"`
+	WebhookSecret    string `mapstructure:"webhookSecret"`
+	WebhookSecretEnv string `mapstructure:"webhookSecretEnv"`
+}
+
+type LatencyConfig struct {
+	Distribution string        `mapstructure:"distribution"` // fixed, uniform, normal or exponential
+	Min          time.Duration `mapstructure:"min"`
+	Max          time.Duration `mapstructure:"max"` // caps every distribution when set
+	Mean         time.Duration `mapstructure:"mean"`
+	StdDev       time.Duration `mapstructure:"stdDev"`
+}
+
+// BankScenario scripts a failure, e.g. account X fails its 3rd reserve
+type BankScenario struct {
+	Account   string `mapstructure:"account"`
+	Operation string `mapstructure:"operation"` // balance, reserve, release or capture
+	Call      int    `mapstructure:"call"`      // which call to fail, counted per account and operation, 0 fails all
+	Fault     string `mapstructure:"fault"`     // error, timeout or insufficient_funds
+}
+
+type RateLimit struct {
+	Requests int           `mapstructure:"requests"`
+	Window   time.Duration `mapstructure:"window"`
+}
+
 func Load() (*Config, error) {
 	v := viper.New()
 	var config Config
@@ -72,6 +216,48 @@ func Load() (*Config, error) {
 	// defaults
 	v.SetDefault("server.host", "localhost")
 	v.SetDefault("server.port", 8080)
+	v.SetDefault("redis.healthInterval", "5s")
+	v.SetDefault("sqs.backend", "sqs")
+	v.SetDefault("sqs.visibilityTimeout", "30s")
+	v.SetDefault("sqs.maxReceiveCount", 4)
+	v.SetDefault("outbox.pollInterval", "1s")
+	v.SetDefault("outbox.batchSize", 50)
+	v.SetDefault("outbox.lease", "30s")
+	v.SetDefault("outbox.maxBackoff", "5m")
+	v.SetDefault("sweeper.enabled", true)
+	v.SetDefault("sweeper.interval", "1m")
+	v.SetDefault("sweeper.batchSize", 100)
+	v.SetDefault("sweeper.retryAfter", "10m")
+	v.SetDefault("auth.hmac.replayWindow", "5m")
+	v.SetDefault("rateLimit.enabled", true)
+	v.SetDefault("rateLimit.failOpen", true)
+	v.SetDefault("rateLimit.perKey.requests", 600)
+	v.SetDefault("rateLimit.perKey.window", "1m")
+	v.SetDefault("rateLimit.perAccount.requests", 60)
+	v.SetDefault("rateLimit.perAccount.window", "1m")
+	v.SetDefault("lock.ttl", "10s")
+	v.SetDefault("lock.wait", "3s")
+	v.SetDefault("idempotency.ttl", "24h")
+	v.SetDefault("idempotency.keyPrefix", "idempotency:")
+	v.SetDefault("idempotency.maxKeyLength", 255)
+	v.SetDefault("idempotency.allowedCharset", "A-Za-z0-9_.:-")
+	v.SetDefault("bank.backend", "db")
+	v.SetDefault("bank.url", "http://localhost:8081")
+	v.SetDefault("bank.timeout", "2s")
+	v.SetDefault("bank.maxRetries", 2)
+	v.SetDefault("bank.retryBackoff", "100ms")
+	v.SetDefault("bank.maxBackoff", "1s")
+	v.SetDefault("bank.breaker.failureThreshold", 5)
+	v.SetDefault("bank.breaker.openTimeout", "30s")
+	v.SetDefault("bank.breaker.halfOpenRequests", 1)
+	v.SetDefault("bank.webhookTolerance", "5m")
+	v.SetDefault("bank.webhookDedupTTL", "30s")
+	v.SetDefault("bank.mock.port", 8081)
+	v.SetDefault("bank.mock.latency.distribution", "uniform")
+	v.SetDefault("bank.mock.latency.max", "50ms")
+	v.SetDefault("bank.mock.hang", "30s")
+	v.SetDefault("idempotency.inFlightTTL", "30s")
+	v.SetDefault("idempotency.inFlightWait", "5s")
 
 	err := v.ReadInConfig()
 	if err != nil {
@@ -83,5 +269,37 @@ func Load() (*Config, error) {
 		return nil, fmt.Errorf("Unable to decode into struct, %v", err)
 	}
 
+	if _, err := regexp.Compile("^[" + config.Idempotency.AllowedCharset + "]+$"); err != nil {
+		return nil, fmt.Errorf("invalid idempotency.allowedCharset: %v", err)
+	}
+
+	// the lock is renewed every ttl/3, redis can't expire it any sooner than 1ms
+	if config.Lock.TTL < time.Millisecond {
+		return nil, fmt.Errorf("invalid lock.ttl %s: must be at least 1ms", config.Lock.TTL)
+	}
+	if config.Lock.Wait < 0 {
+		return nil, fmt.Errorf("invalid lock.wait %s: must not be negative", config.Lock.Wait)
+	}
+
+	// keep hmac secrets out of the config file
+	for i, client := range config.Auth.HMAC.Clients {
+		if client.Secret == "" && client.SecretEnv != "" {
+			config.Auth.HMAC.Clients[i].Secret = os.Getenv(client.SecretEnv)
+		}
+	}
+
+	// and webhook secrets
+	if config.Bank.WebhookSecret == "" && config.Bank.WebhookSecretEnv != "" {
+		config.Bank.WebhookSecret = os.Getenv(config.Bank.WebhookSecretEnv)
+	}
+	if config.Bank.Mock.WebhookSecret == "" && config.Bank.Mock.WebhookSecretEnv != "" {
+		config.Bank.Mock.WebhookSecret = os.Getenv(config.Bank.Mock.WebhookSecretEnv)
+	}
+	for i, provider := range config.Bank.Providers {
+		if provider.WebhookSecret == "" && provider.WebhookSecretEnv != "" {
+			config.Bank.Providers[i].WebhookSecret = os.Getenv(provider.WebhookSecretEnv)
+		}
+	}
+
 	return &config, nil
 }
@@ -0,0 +1,55 @@
+package http
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/drmitchell85/finsys/internal/store"
+)
+
+const (
+	healthOK       = "ok"
+	healthDegraded = "degraded" // serving, with fallbacks for a dependency that's down
+	healthDown     = "down"
+)
+
+type healthResponse struct {
+	Status       string            `json:"status"`
+	Dependencies map[string]string `json:"dependencies"`
+}
+
+// healthHandler reports each dependency. Losing redis only degrades the
+// service, losing postgres takes it down.
+func healthHandler(db *sql.DB, cache *store.CacheMonitor) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		resp := healthResponse{
+			Status: healthOK,
+			Dependencies: map[string]string{
+				"postgres": healthOK,
+				"redis":    healthOK,
+			},
+		}
+		code := http.StatusOK
+
+		if !cache.Healthy() {
+			resp.Status = healthDegraded
+			resp.Dependencies["redis"] = healthDown
+		}
+
+		ctx, cancel := context.WithTimeout(r.Context(), 2*time.Second)
+		defer cancel()
+
+		if err := db.PingContext(ctx); err != nil {
+			resp.Status = healthDown
+			resp.Dependencies["postgres"] = healthDown
+			code = http.StatusServiceUnavailable
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(code)
+		json.NewEncoder(w).Encode(resp)
+	}
+}
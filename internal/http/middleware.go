@@ -0,0 +1,109 @@
+package http
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/drmitchell85/finsys/internal/auth"
+	"github.com/drmitchell85/finsys/internal/utils"
+)
+
+// cap on bodies read into memory before the handler, to verify a signature
+// or peek at the account
+const maxSignedBodyBytes = 1 << 20
+
+// authenticate resolves the caller and puts it on the request context.
+// Signed requests from internal services carry X-Signature, everyone else
+// sends an api key, either as a bearer token or in the X-API-Key header.
+func authenticate(as auth.AuthService) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Header.Get(auth.HeaderSignature) != "" {
+				principal, err := authenticateSigned(as, r)
+				if err != nil {
+					respondError(w, err)
+					return
+				}
+
+				next.ServeHTTP(w, r.WithContext(auth.WithPrincipal(r.Context(), principal)))
+				return
+			}
+
+			rawKey := r.Header.Get("X-API-Key")
+			if rawKey == "" {
+				if bearer, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+					rawKey = strings.TrimSpace(bearer)
+				}
+			}
+
+			if rawKey == "" {
+				respondError(w, utils.NewUnauthorizedError("missing api key", fmt.Errorf("no credentials on request")))
+				return
+			}
+
+			principal, err := as.AuthenticateAPIKey(r.Context(), rawKey)
+			if err != nil {
+				respondError(w, err)
+				return
+			}
+
+			next.ServeHTTP(w, r.WithContext(auth.WithPrincipal(r.Context(), principal)))
+		})
+	}
+}
+
+// authenticateSigned verifies an hmac signed request. The body is read to
+// check the signature and put back for the handler.
+func authenticateSigned(as auth.AuthService, r *http.Request) (*auth.Principal, error) {
+	body, err := peekBody(r)
+	if err != nil {
+		return nil, err
+	}
+
+	return as.AuthenticateHMAC(r.Context(), auth.SignedRequest{
+		ClientID:   r.Header.Get(auth.HeaderClientID),
+		Timestamp:  r.Header.Get(auth.HeaderTimestamp),
+		Signature:  r.Header.Get(auth.HeaderSignature),
+		Method:     r.Method,
+		RequestURI: r.URL.RequestURI(),
+		Body:       body,
+	})
+}
+
+// requireScope rejects callers whose credentials weren't granted the scope
+func requireScope(scope auth.Scope) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			principal, ok := auth.PrincipalFromContext(r.Context())
+			if !ok {
+				respondError(w, utils.NewUnauthorizedError("not authenticated", fmt.Errorf("no principal on request")))
+				return
+			}
+
+			if !principal.HasScope(scope) {
+				respondError(w, utils.NewForbiddenError(fmt.Sprintf("missing scope %s", scope), fmt.Errorf("scope %s not granted", scope)))
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// peekBody reads the request body, up to maxSignedBodyBytes, and puts it
+// back for the handler
+func peekBody(r *http.Request) ([]byte, error) {
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxSignedBodyBytes+1))
+	if err != nil {
+		return nil, utils.NewValidationError("error reading request body", err)
+	}
+	if len(body) > maxSignedBodyBytes {
+		return nil, utils.NewValidationError("request body too large", fmt.Errorf("body over %d bytes", maxSignedBodyBytes))
+	}
+	r.Body = io.NopCloser(bytes.NewReader(body))
+
+	return body, nil
+}
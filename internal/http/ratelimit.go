@@ -0,0 +1,167 @@
+package http
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/drmitchell85/finsys/internal/auth"
+	"github.com/drmitchell85/finsys/internal/config"
+	"github.com/drmitchell85/finsys/internal/ratelimit"
+	"github.com/drmitchell85/finsys/internal/utils"
+)
+
+// route names used to look up per-route limits in config
+const (
+	routeCreateTransaction = "create_transaction"
+	routeListTransactions  = "list_transactions"
+	routeGetTransaction    = "get_transaction"
+	routeGetBalance        = "get_balance"
+)
+
+// rateLimit limits the authenticated caller, across all routes and on this
+// route if it has its own limit configured. With perAccount it also limits
+// money movement out of the request's from_account_id, peeking at the body
+// and putting it back for the handler. Every window is checked at once and
+// the request is only counted if all of them admit it, so a request refused
+// by one limit doesn't use up the others.
+func rateLimit(rl ratelimit.Limiter, cfg config.RateLimitConfig, route string, perAccount bool) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !cfg.Enabled {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			principal, ok := auth.PrincipalFromContext(r.Context())
+			if !ok {
+				respondError(w, utils.NewUnauthorizedError("not authenticated", fmt.Errorf("no principal on request")))
+				return
+			}
+
+			caller := callerKey(principal)
+			checks := []ratelimit.Check{{Key: caller, Limit: toLimit(cfg.PerKey)}}
+			if limit, ok := cfg.Routes[route]; ok {
+				checks = append(checks, ratelimit.Check{Key: caller + ":" + route, Limit: toLimit(limit)})
+			}
+
+			if perAccount {
+				check, err := accountCheck(r, principal, cfg)
+				if err != nil {
+					respondError(w, err)
+					return
+				}
+				if check != nil {
+					checks = append(checks, *check)
+				}
+			}
+
+			if !enforceLimits(w, r, rl, cfg, checks) {
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// accountCheck limits the request's from_account_id. Ownership isn't known
+// yet, so the bucket is per caller and account, otherwise anyone could use
+// up another user's limit by naming their account. A body without an
+// account is left for the handler to reject.
+func accountCheck(r *http.Request, principal *auth.Principal, cfg config.RateLimitConfig) (*ratelimit.Check, error) {
+	body, err := peekBody(r)
+	if err != nil {
+		return nil, err
+	}
+
+	var peek struct {
+		FromAccountID string `json:"from_account_id"`
+	}
+	if json.Unmarshal(body, &peek) != nil || peek.FromAccountID == "" {
+		return nil, nil
+	}
+
+	return &ratelimit.Check{
+		Key:   "account:" + principal.Namespace() + ":" + peek.FromAccountID,
+		Limit: toLimit(cfg.PerAccount),
+	}, nil
+}
+
+func toLimit(limit config.RateLimit) ratelimit.Limit {
+	return ratelimit.Limit{
+		Requests: limit.Requests,
+		Window:   limit.Window,
+	}
+}
+
+func callerKey(p *auth.Principal) string {
+	if p.ClientID != "" {
+		return "client:" + p.ClientID
+	}
+	return "key:" + p.KeyID.String()
+}
+
+// enforceLimits runs every check, writes X-RateLimit-* headers for the most
+// constrained one and responds 429 if any was exceeded, or 503 if the limiter
+// is down and configured to fail closed. It reports whether the request may
+// continue.
+func enforceLimits(w http.ResponseWriter, r *http.Request, rl ratelimit.Limiter, cfg config.RateLimitConfig, checks []ratelimit.Check) bool {
+	// a limit of zero is unlimited
+	active := checks[:0]
+	for _, check := range checks {
+		if check.Limit.Requests > 0 {
+			active = append(active, check)
+		}
+	}
+	if len(active) == 0 {
+		return true
+	}
+
+	results, err := rl.Allow(r.Context(), active...)
+	if err != nil {
+		if !cfg.FailOpen {
+			respondError(w, utils.NewUnavailableError("rate limiter unavailable, try again later", err))
+			return false
+		}
+
+		// don't take the api down with the limiter
+		log.Printf("WARN: rate limiter unavailable, allowing request: %v", err)
+		return true
+	}
+
+	var tightest, denied *ratelimit.Result
+	for _, res := range results {
+		if tightest == nil || res.Remaining < tightest.Remaining {
+			tightest = res
+		}
+		if !res.Allowed && (denied == nil || res.RetryAfter > denied.RetryAfter) {
+			denied = res
+		}
+	}
+
+	if denied != nil {
+		tightest = denied
+	}
+	if tightest != nil {
+		w.Header().Set("X-RateLimit-Limit", strconv.Itoa(tightest.Limit))
+		w.Header().Set("X-RateLimit-Remaining", strconv.Itoa(tightest.Remaining))
+		w.Header().Set("X-RateLimit-Reset", strconv.Itoa(ceilSeconds(tightest.ResetAfter)))
+	}
+
+	if denied != nil {
+		w.Header().Set("Retry-After", strconv.Itoa(ceilSeconds(denied.RetryAfter)))
+		respondError(w, utils.NewRateLimitedError("rate limit exceeded", fmt.Errorf("limit of %d requests reached", denied.Limit)))
+		return false
+	}
+
+	return true
+}
+
+func ceilSeconds(d time.Duration) int {
+	return int(math.Ceil(d.Seconds()))
+}
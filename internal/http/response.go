@@ -16,8 +16,9 @@ type Response struct {
 }
 
 type ErrorResponse struct {
-	Code    string `json:"code"`
-	Message string `json:"message"`
+	Code    string         `json:"code"`
+	Message string         `json:"message"`
+	Details map[string]any `json:"details,omitempty"`
 }
 
 func respondSuccess(w http.ResponseWriter, code int, payload interface{}) {
@@ -42,24 +43,26 @@ func respondError(w http.ResponseWriter, err error) {
 	// check if it's our custom error type
 	if appErr, ok := utils.GetAppError(err); ok {
 		// map error codes to http status codes
-		switch appErr.Code {
-		case utils.ErrValidation:
-			code = http.StatusBadRequest
-		case utils.ErrNotFound:
-			code = http.StatusNotFound
-		case utils.ErrUnauthorized:
-			code = http.StatusUnauthorized
-		case utils.ErrForbidden:
-			code = http.StatusForbidden
-		case utils.ErrInsufficientFunds, utils.ErrAccountNotFound, utils.ErrDuplicateRequest:
-			code = http.StatusBadRequest
-		default:
+		code = utils.HTTPStatus(appErr.Code)
+		if code == http.StatusInternalServerError {
 			// log unknown app errors at error level
 			log.Printf("ERROR: %v", err)
 		}
 
+		switch appErr.Code {
+		case utils.ErrDuplicateRequest, utils.ErrLockTimeout:
+			w.Header().Set("Retry-After", "1")
+		}
+
+		// a failure cached under an idempotency key is replayed as it was sent
+		if appErr.Replayed {
+			code = appErr.Status
+			w.Header().Set("Idempotent-Replayed", "true")
+		}
+
 		errorResponse.Code = string(appErr.Code)
 		errorResponse.Message = appErr.Message
+		errorResponse.Details = appErr.Details
 	} else {
 		// not our error type, log it
 		log.Printf("UNEXPECTED ERROR: %v", err)
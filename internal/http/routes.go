@@ -2,29 +2,77 @@ package http
 
 import (
 	"context"
+	"database/sql"
 	"encoding/json"
+	"fmt"
 	"net/http"
+	"strconv"
+	"strings"
+	"time"
 
+	"github.com/drmitchell85/finsys/internal/auth"
+	"github.com/drmitchell85/finsys/internal/bank"
+	"github.com/drmitchell85/finsys/internal/config"
 	"github.com/drmitchell85/finsys/internal/models"
+	"github.com/drmitchell85/finsys/internal/ratelimit"
+	"github.com/drmitchell85/finsys/internal/store"
 	"github.com/drmitchell85/finsys/internal/transaction"
+	"github.com/drmitchell85/finsys/internal/utils"
 	"github.com/go-chi/chi"
 	"github.com/go-playground/validator"
+	"github.com/google/uuid"
 )
 
-func addRoutes(r *chi.Mux, ts transaction.TransactionService, ctx context.Context) {
+func addRoutes(r *chi.Mux, ts transaction.TransactionService, as auth.AuthService, rl ratelimit.Limiter, rlConfig config.RateLimitConfig, db *sql.DB, cache *store.CacheMonitor) {
 
-	r.Get("/health", func(w http.ResponseWriter, r *http.Request) {
-		w.Write([]byte("Ping!"))
-	})
+	r.Get("/health", healthHandler(db, cache))
+
+	// providers authenticate with their webhook signature, not a caller key
+	r.Post("/webhooks/provider/{name}", providerWebhookHandler(ts))
+
+	r.Group(func(r chi.Router) {
+		r.Use(authenticate(as))
+
+		r.With(
+			requireScope(auth.ScopeTransactionsWrite),
+			rateLimit(rl, rlConfig, routeCreateTransaction, true),
+		).Post("/transaction", createTransactionHandler(ts))
+
+		r.With(
+			requireScope(auth.ScopeTransactionsRead),
+			rateLimit(rl, rlConfig, routeListTransactions, false),
+		).Get("/transaction", listTransactionsHandler(ts))
+
+		r.With(
+			requireScope(auth.ScopeTransactionsRead),
+			rateLimit(rl, rlConfig, routeGetTransaction, false),
+		).Get("/transaction/idempotency-key/{key}", getTransactionByIdempotencyKeyHandler(ts))
+
+		r.With(
+			requireScope(auth.ScopeTransactionsRead),
+			rateLimit(rl, rlConfig, routeGetTransaction, false),
+		).Get("/transaction/{id}", getTransactionHandler(ts))
+
+		r.With(
+			requireScope(auth.ScopeTransactionsRead),
+			rateLimit(rl, rlConfig, routeGetTransaction, false),
+		).Get("/transaction/{id}/entries", getTransactionEntriesHandler(ts))
 
-	r.Post("/transaction", createTransactionHandler(ts, ctx))
+		r.With(
+			requireScope(auth.ScopeTransactionsRead),
+			rateLimit(rl, rlConfig, routeGetBalance, false),
+		).Get("/account/{id}/balance", getAccountBalanceHandler(ts))
+	})
 
 }
 
 var validate = validator.New()
 
-func createTransactionHandler(ts transaction.TransactionService, ctx context.Context) http.HandlerFunc {
+func createTransactionHandler(ts transaction.TransactionService) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
+		// don't let a client disconnect abort money movement halfway through
+		ctx := context.WithoutCancel(r.Context())
+
 		var reqObj models.CreateTransactionRequest
 		err := json.NewDecoder(r.Body).Decode(&reqObj)
 		if err != nil {
@@ -37,12 +85,206 @@ func createTransactionHandler(ts transaction.TransactionService, ctx context.Con
 			return
 		}
 
-		_, err = ts.CreateTransaction(ctx, reqObj)
+		resp, err := ts.CreateTransaction(ctx, reqObj)
+		if err != nil {
+			respondError(w, err)
+			return
+		}
+
+		w.Header().Set("Location", fmt.Sprintf("/transaction/%s", resp.TransactionID))
+
+		if resp.Replayed {
+			w.Header().Set("Idempotent-Replayed", "true")
+			respondSuccess(w, http.StatusOK, resp)
+			return
+		}
+
+		respondSuccess(w, http.StatusCreated, resp)
+	}
+}
+
+func getTransactionHandler(ts transaction.TransactionService) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		txID, err := uuid.Parse(chi.URLParam(r, "id"))
+		if err != nil {
+			respondError(w, utils.NewValidationError("invalid transaction id", err))
+			return
+		}
+
+		tx, err := ts.GetTransaction(r.Context(), txID)
+		if err != nil {
+			respondError(w, err)
+			return
+		}
+
+		respondSuccess(w, http.StatusOK, tx)
+	}
+}
+
+func getTransactionByIdempotencyKeyHandler(ts transaction.TransactionService) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		tx, err := ts.GetTransactionByIdempotencyKey(r.Context(), chi.URLParam(r, "key"))
+		if err != nil {
+			respondError(w, err)
+			return
+		}
+
+		respondSuccess(w, http.StatusOK, tx)
+	}
+}
+
+func getTransactionEntriesHandler(ts transaction.TransactionService) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		txID, err := uuid.Parse(chi.URLParam(r, "id"))
+		if err != nil {
+			respondError(w, utils.NewValidationError("invalid transaction id", err))
+			return
+		}
+
+		entries, err := ts.GetTransactionEntries(r.Context(), txID)
+		if err != nil {
+			respondError(w, err)
+			return
+		}
+
+		respondSuccess(w, http.StatusOK, entries)
+	}
+}
+
+func getAccountBalanceHandler(ts transaction.TransactionService) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		accountID, err := uuid.Parse(chi.URLParam(r, "id"))
+		if err != nil {
+			respondError(w, utils.NewValidationError("invalid account id", err))
+			return
+		}
+
+		currency := r.URL.Query().Get("currency")
+		if len(currency) != 3 {
+			respondError(w, utils.NewValidationError("currency must be a 3 letter code", fmt.Errorf("invalid currency %q", currency)))
+			return
+		}
+
+		balances, err := ts.GetAccountBalances(r.Context(), accountID, currency)
+		if err != nil {
+			respondError(w, err)
+			return
+		}
+
+		respondSuccess(w, http.StatusOK, balances)
+	}
+}
+
+func listTransactionsHandler(ts transaction.TransactionService) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		filter, err := parseTransactionFilter(r)
+		if err != nil {
+			respondError(w, err)
+			return
+		}
+
+		resp, err := ts.ListTransactions(r.Context(), *filter)
+		if err != nil {
+			respondError(w, err)
+			return
+		}
+
+		respondSuccess(w, http.StatusOK, resp)
+	}
+}
+
+func providerWebhookHandler(ts transaction.TransactionService) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// the event has to be applied once accepted, whether or not the
+		// provider is still waiting
+		ctx := context.WithoutCancel(r.Context())
+
+		body, err := peekBody(r)
+		if err != nil {
+			respondError(w, err)
+			return
+		}
+
+		err = ts.HandleProviderWebhook(ctx, chi.URLParam(r, "name"), r.Header.Get(bank.HeaderWebhookSignature), body)
 		if err != nil {
 			respondError(w, err)
 			return
 		}
 
-		respondSuccess(w, 201, nil)
+		respondSuccess(w, http.StatusOK, nil)
+	}
+}
+
+// parseTransactionFilter reads the listing filters off the query string
+func parseTransactionFilter(r *http.Request) (*models.TransactionFilter, error) {
+	q := r.URL.Query()
+	filter := &models.TransactionFilter{}
+
+	accountID, err := uuid.Parse(q.Get("account_id"))
+	if err != nil {
+		return nil, utils.NewValidationError("account_id must be a valid uuid", err)
+	}
+	filter.AccountID = accountID
+
+	if v := q.Get("status"); v != "" {
+		status := models.TransactionStatus(v)
+		switch status {
+		case models.TransactionPending, models.TransactionProcessing, models.TransactionCompleted,
+			models.TransactionFailed, models.TransactionCancelled:
+			filter.Status = &status
+		default:
+			return nil, utils.NewValidationError(fmt.Sprintf("unknown status %q", v), fmt.Errorf("invalid status"))
+		}
+	}
+
+	if v := q.Get("created_after"); v != "" {
+		t, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			return nil, utils.NewValidationError("created_after must be an RFC3339 timestamp", err)
+		}
+		filter.CreatedAfter = &t
+	}
+
+	if v := q.Get("created_before"); v != "" {
+		t, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			return nil, utils.NewValidationError("created_before must be an RFC3339 timestamp", err)
+		}
+		filter.CreatedBefore = &t
 	}
+
+	if v := q.Get("limit"); v != "" {
+		limit, err := strconv.Atoi(v)
+		if err != nil || limit <= 0 {
+			return nil, utils.NewValidationError("limit must be a positive integer", fmt.Errorf("invalid limit %q", v))
+		}
+		filter.Limit = limit
+	}
+
+	// metadata filters come in as metadata[key]=value
+	for param, values := range q {
+		if !strings.HasPrefix(param, "metadata[") || !strings.HasSuffix(param, "]") {
+			continue
+		}
+
+		key := strings.TrimSuffix(strings.TrimPrefix(param, "metadata["), "]")
+		if key == "" || len(values) != 1 {
+			return nil, utils.NewValidationError(fmt.Sprintf("invalid metadata filter %q", param), fmt.Errorf("bad metadata filter"))
+		}
+
+		if filter.Metadata == nil {
+			filter.Metadata = map[string]string{}
+		}
+		filter.Metadata[key] = values[0]
+	}
+
+	if v := q.Get("cursor"); v != "" {
+		cursor, err := transaction.DecodeCursor(v)
+		if err != nil {
+			return nil, err
+		}
+		filter.Cursor = cursor
+	}
+
+	return filter, nil
 }
@@ -9,9 +9,12 @@ import (
 	"net/http"
 	"os"
 
+	"github.com/drmitchell85/finsys/internal/auth"
 	"github.com/drmitchell85/finsys/internal/bank"
 	"github.com/drmitchell85/finsys/internal/config"
+	"github.com/drmitchell85/finsys/internal/ledger"
 	"github.com/drmitchell85/finsys/internal/messenger"
+	"github.com/drmitchell85/finsys/internal/ratelimit"
 	"github.com/drmitchell85/finsys/internal/store"
 	"github.com/drmitchell85/finsys/internal/transaction"
 	"github.com/go-chi/chi"
@@ -21,14 +24,19 @@ import (
 type Server struct {
 	db           *sql.DB
 	httpServer   *http.Server
-	queueService *messenger.QueueService // for publishing to sqs
-	redis        *redis.Client           // for idempotency + distributed locks
+	queueService *messenger.QueueService // for publishing to the queue
+	redis        *redis.Client           // for idempotency, rate limiting + distributed locks
+	cache        *store.CacheMonitor     // tracks whether redis is up
 	logger       *slog.Logger            // structured logging
 	config       *config.Config          // app configuration
-	httpClient   *http.Client            // for calling account service
+	httpClient   *http.Client            // for calling the bank
+	ctx          context.Context         // cancelled on shutdown to stop background work
+	cancel       context.CancelFunc
 }
 
 func (s *Server) Start() error {
+	go s.cache.Run(s.ctx)
+
 	log.Printf("listening on %s\n", s.httpServer.Addr)
 	if err := s.httpServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
 		return fmt.Errorf("error listening and serving: %w", err)
@@ -38,6 +46,7 @@ func (s *Server) Start() error {
 }
 
 func (s *Server) Shutdown(ctx context.Context) {
+	s.cancel()
 
 	if err := s.httpServer.Shutdown(ctx); err != nil {
 		log.Printf("error shutting down server: %v", err)
@@ -68,9 +77,15 @@ func NewServer() (*Server, error) {
 		return nil, fmt.Errorf("error starting cache: %s", err)
 	}
 	server.redis = rds
+	server.httpClient = &http.Client{Timeout: config.Bank.Timeout}
+	server.cache = store.NewCacheMonitor(rds, config.Redis.HealthInterval)
+	server.ctx, server.cancel = context.WithCancel(ctx)
 
-	queueService := messenger.NewQueueService(*config)
-	server.queueService = queueService
+	queue, err := messenger.NewQueue(*config, db)
+	if err != nil {
+		return nil, fmt.Errorf("error starting queue: %s", err)
+	}
+	server.queueService = messenger.NewQueueService(queue)
 
 	httpServer, err := initHttpServer(config, &server, ctx)
 	if err != nil {
@@ -90,9 +105,18 @@ func initHttpServer(config *config.Config, server *Server, ctx context.Context)
 
 	logger := slog.New(slog.NewJSONHandler(os.Stdout, nil))
 	rs := store.NewRepositoryService(server.db, server.redis)
-	bs := bank.NewBankService(server.db)
-	ts := transaction.NewTransactionService(rs, server.queueService, bs, logger)
-	addRoutes(router, ts, ctx)
+	providers, err := bank.NewRouter(*config, server.db, server.httpClient)
+	if err != nil {
+		return nil, fmt.Errorf("error starting bank service: %s", err)
+	}
+	locker := store.NewLocker(server.redis, server.db)
+	ts := transaction.NewTransactionService(rs, ledger.NewLedgerService(server.db), server.queueService, providers, locker, logger, *config)
+	as, err := auth.NewAuthService(rs, server.redis, config.Auth)
+	if err != nil {
+		return nil, fmt.Errorf("error starting auth service: %s", err)
+	}
+	rl := ratelimit.NewLimiter(server.redis)
+	addRoutes(router, ts, as, rl, config.RateLimit, server.db, server.cache)
 
 	return httpServer, nil
 }
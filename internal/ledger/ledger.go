@@ -0,0 +1,258 @@
+package ledger
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/drmitchell85/finsys/internal/models"
+	"github.com/drmitchell85/finsys/internal/utils"
+	"github.com/google/uuid"
+	"github.com/shopspring/decimal"
+)
+
+// Event is the lifecycle step of a transaction that produced a journal entry
+type Event string
+
+const (
+	EventCreated   Event = "created"
+	EventCompleted Event = "completed"
+	EventFailed    Event = "failed"
+	EventCancelled Event = "cancelled"
+)
+
+// AccountKind splits a platform account into the buckets money moves between
+type AccountKind string
+
+const (
+	KindAvailable AccountKind = "available" // settled funds the account owner can pay out
+	KindPending   AccountKind = "pending"   // funds owed to the account but not yet settled
+	KindClearing  AccountKind = "clearing"  // funds pulled from the account's external bank
+)
+
+// Kinds lists every bucket an account has
+var Kinds = []AccountKind{KindAvailable, KindPending, KindClearing}
+
+type Direction string
+
+const (
+	Debit  Direction = "debit"
+	Credit Direction = "credit"
+)
+
+type Posting struct {
+	AccountID uuid.UUID       `json:"account_id"`
+	Kind      AccountKind     `json:"account_kind"`
+	Direction Direction       `json:"direction"`
+	Amount    decimal.Decimal `json:"amount"`
+	Currency  string          `json:"currency"`
+}
+
+type JournalEntry struct {
+	ID            uuid.UUID `json:"id"`
+	TransactionID uuid.UUID `json:"transaction_id"`
+	Event         Event     `json:"event"`
+	Postings      []Posting `json:"postings"`
+	CreatedAt     time.Time `json:"created_at"`
+}
+
+// Balance of a single account bucket. Credits increase it, debits reduce it,
+// so clearing balances go negative as money is pulled in from the bank.
+type Balance struct {
+	AccountID uuid.UUID       `json:"account_id"`
+	Kind      AccountKind     `json:"account_kind"`
+	Currency  string          `json:"currency"`
+	Amount    decimal.Decimal `json:"amount"`
+}
+
+// Validate makes sure debits and credits balance out for every currency
+func (e *JournalEntry) Validate() error {
+	if len(e.Postings) < 2 {
+		return utils.NewValidationError("journal entry needs at least two postings", fmt.Errorf("entry for %s has %d postings", e.TransactionID, len(e.Postings)))
+	}
+
+	sums := map[string]decimal.Decimal{}
+	for _, p := range e.Postings {
+		if !p.Amount.IsPositive() {
+			return utils.NewValidationError("posting amounts must be positive", fmt.Errorf("posting amount %s", p.Amount))
+		}
+
+		switch p.Direction {
+		case Debit:
+			sums[p.Currency] = sums[p.Currency].Add(p.Amount)
+		case Credit:
+			sums[p.Currency] = sums[p.Currency].Sub(p.Amount)
+		default:
+			return utils.NewValidationError("unknown posting direction", fmt.Errorf("direction %q", p.Direction))
+		}
+	}
+
+	for currency, sum := range sums {
+		if !sum.IsZero() {
+			return utils.NewValidationError("journal entry does not balance", fmt.Errorf("%s postings off by %s", currency, sum))
+		}
+	}
+
+	return nil
+}
+
+// EventForTransition returns the ledger event a status change produces, if any
+func EventForTransition(to models.TransactionStatus) (Event, bool) {
+	switch to {
+	case models.TransactionCompleted:
+		return EventCompleted, true
+	case models.TransactionFailed:
+		return EventFailed, true
+	case models.TransactionCancelled:
+		return EventCancelled, true
+	default:
+		return "", false
+	}
+}
+
+// NewEntry builds the double-entry postings for a transaction event:
+//
+//	created:          debit payer clearing, credit payee pending
+//	completed:        debit payee pending,  credit payee available
+//	failed/cancelled: debit payee pending,  credit payer clearing
+func NewEntry(event Event, tx *models.Transaction) (*JournalEntry, error) {
+	if tx.ToAccountID == nil {
+		return nil, utils.NewValidationError("transaction has no destination account", fmt.Errorf("missing to_account_id on %s", tx.ID))
+	}
+
+	from := tx.FromAccountID
+	to := *tx.ToAccountID
+
+	var debit, credit Posting
+	switch event {
+	case EventCreated:
+		debit = Posting{AccountID: from, Kind: KindClearing}
+		credit = Posting{AccountID: to, Kind: KindPending}
+	case EventCompleted:
+		debit = Posting{AccountID: to, Kind: KindPending}
+		credit = Posting{AccountID: to, Kind: KindAvailable}
+	case EventFailed, EventCancelled:
+		debit = Posting{AccountID: to, Kind: KindPending}
+		credit = Posting{AccountID: from, Kind: KindClearing}
+	default:
+		return nil, utils.NewInternalError(fmt.Errorf("unknown ledger event %q", event))
+	}
+
+	debit.Direction, credit.Direction = Debit, Credit
+	debit.Amount, credit.Amount = tx.Amount, tx.Amount
+	debit.Currency, credit.Currency = tx.Currency, tx.Currency
+
+	entry := &JournalEntry{
+		TransactionID: tx.ID,
+		Event:         event,
+		Postings:      []Posting{debit, credit},
+	}
+
+	return entry, entry.Validate()
+}
+
+// Post writes a journal entry and its postings inside the caller's db
+// transaction, so the ledger commits or rolls back with the status change
+func Post(ctx context.Context, dbtx *sql.Tx, entry *JournalEntry) error {
+	if err := entry.Validate(); err != nil {
+		return err
+	}
+
+	err := dbtx.QueryRowContext(ctx,
+		"INSERT INTO journal_entries (transaction_id, event) VALUES ($1, $2) RETURNING id, created_at",
+		entry.TransactionID, entry.Event).Scan(&entry.ID, &entry.CreatedAt)
+	if err != nil {
+		return utils.NewInternalError(fmt.Errorf("error writing journal entry: %w", err))
+	}
+
+	for _, p := range entry.Postings {
+		_, err = dbtx.ExecContext(ctx,
+			`INSERT INTO postings (journal_entry_id, account_id, account_kind, direction, amount, currency)
+             VALUES ($1, $2, $3, $4, $5, $6)`,
+			entry.ID, p.AccountID, p.Kind, p.Direction, p.Amount, p.Currency)
+		if err != nil {
+			return utils.NewInternalError(fmt.Errorf("error writing posting: %w", err))
+		}
+	}
+
+	return nil
+}
+
+type LedgerService interface {
+	GetBalance(ctx context.Context, accountID uuid.UUID, kind AccountKind, currency string) (*Balance, error)
+	GetEntries(ctx context.Context, transactionID uuid.UUID) ([]JournalEntry, error)
+}
+
+type ledgerService struct {
+	db *sql.DB
+}
+
+func NewLedgerService(db *sql.DB) LedgerService {
+	return &ledgerService{
+		db: db,
+	}
+}
+
+func (ls *ledgerService) GetBalance(ctx context.Context, accountID uuid.UUID, kind AccountKind, currency string) (*Balance, error) {
+	balance := &Balance{
+		AccountID: accountID,
+		Kind:      kind,
+		Currency:  currency,
+	}
+
+	err := ls.db.QueryRowContext(ctx, `
+        SELECT COALESCE(SUM(CASE WHEN direction = 'credit' THEN amount ELSE -amount END), 0)
+        FROM postings
+        WHERE account_id = $1 AND account_kind = $2 AND currency = $3
+    `, accountID, kind, currency).Scan(&balance.Amount)
+	if err != nil {
+		return nil, utils.NewInternalError(fmt.Errorf("db error: %w", err))
+	}
+
+	return balance, nil
+}
+
+func (ls *ledgerService) GetEntries(ctx context.Context, transactionID uuid.UUID) ([]JournalEntry, error) {
+	rows, err := ls.db.QueryContext(ctx, `
+        SELECT je.id, je.event, je.created_at, p.account_id, p.account_kind, p.direction, p.amount, p.currency
+        FROM journal_entries je
+        JOIN postings p ON p.journal_entry_id = je.id
+        WHERE je.transaction_id = $1
+        ORDER BY je.created_at, je.id, p.id
+    `, transactionID)
+	if err != nil {
+		return nil, utils.NewInternalError(fmt.Errorf("db error: %w", err))
+	}
+	defer rows.Close()
+
+	var entries []JournalEntry
+	for rows.Next() {
+		var id uuid.UUID
+		var event Event
+		var createdAt time.Time
+		var p Posting
+
+		err := rows.Scan(&id, &event, &createdAt, &p.AccountID, &p.Kind, &p.Direction, &p.Amount, &p.Currency)
+		if err != nil {
+			return nil, utils.NewInternalError(fmt.Errorf("db error: %w", err))
+		}
+
+		if len(entries) == 0 || entries[len(entries)-1].ID != id {
+			entries = append(entries, JournalEntry{
+				ID:            id,
+				TransactionID: transactionID,
+				Event:         event,
+				CreatedAt:     createdAt,
+			})
+		}
+		last := &entries[len(entries)-1]
+		last.Postings = append(last.Postings, p)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, utils.NewInternalError(fmt.Errorf("db error: %w", err))
+	}
+
+	return entries, nil
+}
@@ -0,0 +1,170 @@
+package messenger
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/drmitchell85/finsys/internal/config"
+	"github.com/drmitchell85/finsys/internal/utils"
+	"github.com/google/uuid"
+)
+
+// how often a waiting Receive rechecks an empty queue
+const memoryPollInterval = 50 * time.Millisecond
+
+// how long a dedup key blocks resends, matching sqs fifo queues
+const memoryDedupWindow = 5 * time.Minute
+
+type memoryDedup struct {
+	id     string
+	expiry time.Time
+}
+
+type memoryMessage struct {
+	id            string
+	body          string
+	receiptHandle string
+	receiveCount  int
+	visibleAt     time.Time
+}
+
+// memoryQueue is a process-local Queue for tests and running without sqs.
+// It mimics sqs semantics: visibility timeouts, fifo dedup and dlq redrive.
+type memoryQueue struct {
+	mu                sync.Mutex
+	queues            map[string][]*memoryMessage
+	dedup             map[string]memoryDedup // keyed by queueType + dedup key
+	nextID            int
+	maxMessages       int
+	wait              time.Duration
+	visibilityTimeout time.Duration
+	maxReceiveCount   int
+}
+
+func NewMemoryQueue(config config.SQSConfig) Queue {
+	return &memoryQueue{
+		queues:            map[string][]*memoryMessage{},
+		dedup:             map[string]memoryDedup{},
+		maxMessages:       config.MaxNumberOfMessages,
+		wait:              time.Duration(config.WaitTimeSeconds) * time.Second,
+		visibilityTimeout: config.VisibilityTimeout,
+		maxReceiveCount:   config.MaxReceiveCount,
+	}
+}
+
+func (q *memoryQueue) Enqueue(ctx context.Context, queueType string, body string, dedupKey string) (string, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	now := time.Now()
+	for key, d := range q.dedup {
+		if !now.Before(d.expiry) {
+			delete(q.dedup, key)
+		}
+	}
+
+	key := queueType + ":" + dedupKey
+	if d, ok := q.dedup[key]; ok {
+		// duplicate inside the window, accepted but not delivered again
+		return d.id, nil
+	}
+
+	q.nextID++
+	msg := &memoryMessage{
+		id:        strconv.Itoa(q.nextID),
+		body:      body,
+		visibleAt: now,
+	}
+	q.queues[queueType] = append(q.queues[queueType], msg)
+	q.dedup[key] = memoryDedup{id: msg.id, expiry: now.Add(memoryDedupWindow)}
+
+	return msg.id, nil
+}
+
+func (q *memoryQueue) Receive(ctx context.Context, queueType string) ([]ReceivedMessage, error) {
+	deadline := time.Now().Add(q.wait)
+
+	for {
+		msgs := q.receiveVisible(queueType)
+		if len(msgs) > 0 || !time.Now().Before(deadline) {
+			return msgs, nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(memoryPollInterval):
+		}
+	}
+}
+
+func (q *memoryQueue) receiveVisible(queueType string) []ReceivedMessage {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	now := time.Now()
+	var msgs []ReceivedMessage
+	remaining := q.queues[queueType][:0]
+
+	for _, msg := range q.queues[queueType] {
+		if len(msgs) >= q.maxMessages || now.Before(msg.visibleAt) {
+			remaining = append(remaining, msg)
+			continue
+		}
+
+		if q.maxReceiveCount > 0 && msg.receiveCount >= q.maxReceiveCount {
+			if dlq, ok := deadLetterQueueFor(queueType); ok {
+				msg.receiveCount = 0
+				msg.receiptHandle = ""
+				q.queues[dlq] = append(q.queues[dlq], msg)
+				continue
+			}
+		}
+
+		msg.receiveCount++
+		msg.receiptHandle = uuid.NewString()
+		msg.visibleAt = now.Add(q.visibilityTimeout)
+		remaining = append(remaining, msg)
+
+		msgs = append(msgs, ReceivedMessage{
+			ID:            msg.id,
+			ReceiptHandle: msg.receiptHandle,
+			Body:          msg.body,
+			ReceiveCount:  msg.receiveCount,
+		})
+	}
+
+	q.queues[queueType] = remaining
+	return msgs
+}
+
+func (q *memoryQueue) Delete(ctx context.Context, queueType string, receiptHandle string) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	for i, msg := range q.queues[queueType] {
+		if msg.receiptHandle == receiptHandle {
+			q.queues[queueType] = append(q.queues[queueType][:i], q.queues[queueType][i+1:]...)
+			return nil
+		}
+	}
+
+	return utils.NewInternalError(fmt.Errorf("failed to delete message: receipt handle %s not found", receiptHandle))
+}
+
+func (q *memoryQueue) ChangeVisibility(ctx context.Context, queueType string, receiptHandle string, timeout time.Duration) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	for _, msg := range q.queues[queueType] {
+		if msg.receiptHandle == receiptHandle {
+			msg.visibleAt = time.Now().Add(timeout)
+			return nil
+		}
+	}
+
+	return utils.NewInternalError(fmt.Errorf("failed to change message visibility: receipt handle %s not found", receiptHandle))
+}
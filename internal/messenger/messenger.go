@@ -2,80 +2,89 @@ package messenger
 
 import (
 	"context"
+	"database/sql"
 	"encoding/json"
 	"fmt"
-	"log"
-	"os"
 	"time"
 
-	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/credentials"
-	"github.com/aws/aws-sdk-go/aws/session"
-	"github.com/aws/aws-sdk-go/service/sqs"
 	"github.com/drmitchell85/finsys/internal/config"
 	"github.com/drmitchell85/finsys/internal/models"
 	"github.com/drmitchell85/finsys/internal/utils"
 	"github.com/google/uuid"
 )
 
-type QueueService struct {
-	client               *sqs.SQS
-	transactionQueueURL  string
-	transactionDLQURL    string
-	notificationQueueURL string
-	notificationDLQURL   string
-	maxNumberOfMessages  int
-	waitTimeSeconds      int
+// queue types understood by every Queue implementation
+const (
+	QueueTransaction     = "transaction"
+	QueueNotification    = "notification"
+	QueueTransactionDLQ  = "transactiondlq"
+	QueueNotificationDLQ = "notificationdlq"
+)
+
+// Queue is the transport underneath QueueService. Implementations map the
+// queue types above to their own queue names.
+type Queue interface {
+	Enqueue(ctx context.Context, queueType string, body string, dedupKey string) (string, error)
+	Receive(ctx context.Context, queueType string) ([]ReceivedMessage, error)
+	Delete(ctx context.Context, queueType string, receiptHandle string) error
+	ChangeVisibility(ctx context.Context, queueType string, receiptHandle string, timeout time.Duration) error
 }
 
-func NewQueueService(config config.Config) *QueueService {
-	client := initSQSClient(config)
+// ReceivedMessage is a message pulled off a queue, invisible to other
+// consumers until it's deleted or its visibility timeout runs out
+type ReceivedMessage struct {
+	ID            string
+	ReceiptHandle string
+	Body          string
+	ReceiveCount  int
+}
 
-	// construct queue URLs - format differs between localstack and aws
-	prefix := ""
-	if os.Getenv("LOCAL_DEV") == "true" {
-		// localstack format: http://localhost:4566/000000000000/queue-name
-		prefix = fmt.Sprintf("%s/000000000000/", config.AWS.Host)
+// NewQueue builds the Queue backend selected by sqs.backend in the config
+func NewQueue(config config.Config, db *sql.DB) (Queue, error) {
+	switch config.SQS.Backend {
+	case "", "sqs":
+		return newSQSQueue(config), nil
+	case "memory":
+		return NewMemoryQueue(config.SQS), nil
+	case "postgres":
+		return NewPostgresQueue(db, config.SQS), nil
+	default:
+		return nil, fmt.Errorf("unknown queue backend %q", config.SQS.Backend)
 	}
+}
 
-	return &QueueService{
-		client:               client,
-		transactionQueueURL:  prefix + config.SQS.TransactionQueue,
-		transactionDLQURL:    prefix + config.SQS.TransactionDLQ,
-		notificationQueueURL: prefix + config.SQS.NotificationQueue,
-		notificationDLQURL:   prefix + config.SQS.NotificationDLQ,
-		maxNumberOfMessages:  config.SQS.MaxNumberOfMessages,
-		waitTimeSeconds:      config.SQS.WaitTimeSeconds,
+// deadLetterQueueFor returns the dlq messages are moved to after too many receives
+func deadLetterQueueFor(queueType string) (string, bool) {
+	switch queueType {
+	case QueueTransaction:
+		return QueueTransactionDLQ, true
+	case QueueNotification:
+		return QueueNotificationDLQ, true
+	default:
+		return "", false
 	}
 }
 
-func initSQSClient(config config.Config) *sqs.SQS {
-	var sess *session.Session
-
-	if os.Getenv("LOCAL_DEV") == "true" {
-		sess = session.Must(session.NewSessionWithOptions(session.Options{
-			Config: aws.Config{
-				Endpoint:    aws.String(config.AWS.Host),
-				Region:      aws.String(config.AWS.Region),
-				DisableSSL:  aws.Bool(true),
-				Credentials: credentials.NewStaticCredentials("test", "test", ""),
-			},
-		}))
-	} else {
-		sess = session.Must(session.NewSessionWithOptions(session.Options{
-			SharedConfigState: session.SharedConfigEnable,
-		}))
+// queueNames maps queue types to the names configured for them
+func queueNames(config config.SQSConfig) map[string]string {
+	return map[string]string{
+		QueueTransaction:     config.TransactionQueue,
+		QueueNotification:    config.NotificationQueue,
+		QueueTransactionDLQ:  config.TransactionDLQ,
+		QueueNotificationDLQ: config.NotificationDLQ,
 	}
+}
 
-	sqsClient := sqs.New(sess)
-
-	log.Println("connected to sqs")
-
-	return sqsClient
+// QueueService wraps payloads in a models.Message envelope and sends them
+// through whichever Queue backend it was given
+type QueueService struct {
+	queue Queue
 }
 
-func (s *QueueService) GetClient() *sqs.SQS {
-	return s.client
+func NewQueueService(queue Queue) *QueueService {
+	return &QueueService{
+		queue: queue,
+	}
 }
 
 func (s *QueueService) EnqueueMessage(ctx context.Context, msgType string, payload any, idempKey string) (string, error) {
@@ -96,38 +105,7 @@ func (s *QueueService) EnqueueMessage(ctx context.Context, msgType string, paylo
 		return "", utils.NewInternalError(fmt.Errorf("error marshaling message: %w", err))
 	}
 
-	// Determine which queue to use based on message type
-	queueURL, err := s.getQueueURLForType(msgType)
-	if err != nil {
-		return "", utils.NewInternalError(fmt.Errorf("error determining queue url: %w", err))
-	}
-
-	res, err := s.client.SendMessageWithContext(ctx, &sqs.SendMessageInput{
-		QueueUrl:               aws.String(queueURL),
-		MessageBody:            aws.String(string(data)),
-		MessageDeduplicationId: aws.String(idempKey), // for FIFO queues
-		MessageGroupId:         aws.String(msgType),  // for FIFO queues
-	})
-	if err != nil {
-		return "", utils.WrapError(err, utils.ErrInternal, "error sending message")
-	}
-
-	return *res.MessageId, nil
-}
-
-func (s *QueueService) getQueueURLForType(msgType string) (string, error) {
-	switch msgType {
-	case "transaction":
-		return s.transactionQueueURL, nil
-	case "notification":
-		return s.notificationQueueURL, nil
-	case "transactiondlq":
-		return s.transactionDLQURL, nil
-	case "notificationdlq":
-		return s.notificationDLQURL, nil
-	default:
-		return "", utils.NewInternalError(fmt.Errorf("missing message type"))
-	}
+	return s.queue.Enqueue(ctx, msgType, string(data), idempKey)
 }
 
 // Helper methods for common message types
@@ -138,10 +116,13 @@ func (s *QueueService) EnqueueTransaction(ctx context.Context, txID uuid.UUID, i
 		Operation:      operation,
 	}
 
-	return s.EnqueueMessage(ctx, "transaction", payload, idempKey)
+	return s.EnqueueMessage(ctx, QueueTransaction, payload, idempKey)
 }
 
-func (s *QueueService) EnqueueNotification(ctx context.Context, userID uuid.UUID, templateID string, destination string, data any) (string, error) {
+// EnqueueNotification sends a notification once per subject, e.g. the
+// transaction it's about, so retries don't notify twice but separate events
+// for the same user all go out
+func (s *QueueService) EnqueueNotification(ctx context.Context, userID uuid.UUID, templateID string, destination string, subject string, data any) (string, error) {
 	payload := models.NotificationPayload{
 		UserID:      userID,
 		TemplateID:  templateID,
@@ -149,58 +130,22 @@ func (s *QueueService) EnqueueNotification(ctx context.Context, userID uuid.UUID
 		Data:        data,
 	}
 
-	idempKey := fmt.Sprintf("notify:%s:%s:%s", userID, templateID, destination)
-	return s.EnqueueMessage(ctx, "notification", payload, idempKey)
+	idempKey := fmt.Sprintf("notify:%s:%s:%s:%s", userID, templateID, destination, subject)
+	return s.EnqueueMessage(ctx, QueueNotification, payload, idempKey)
 }
 
-func (s *QueueService) ReceiveTransactions() ([]*sqs.Message, error) {
-	res, err := s.client.ReceiveMessage(&sqs.ReceiveMessageInput{
-		QueueUrl:            aws.String(s.transactionQueueURL),
-		AttributeNames:      aws.StringSlice([]string{"All"}),
-		MaxNumberOfMessages: aws.Int64(int64(s.maxNumberOfMessages)),
-		WaitTimeSeconds:     aws.Int64(int64(s.waitTimeSeconds)),
-	})
-	if err != nil {
-		return nil, utils.NewInternalError(fmt.Errorf("error receiving messages: %w", err))
-	}
-
-	return res.Messages, nil
+func (s *QueueService) ReceiveTransactions(ctx context.Context) ([]ReceivedMessage, error) {
+	return s.queue.Receive(ctx, QueueTransaction)
 }
 
-func (s *QueueService) ReceiveNotifications() ([]*sqs.Message, error) {
-	res, err := s.client.ReceiveMessage(&sqs.ReceiveMessageInput{
-		QueueUrl:            aws.String(s.notificationQueueURL),
-		AttributeNames:      aws.StringSlice([]string{"All"}),
-		MaxNumberOfMessages: aws.Int64(int64(s.maxNumberOfMessages)),
-		WaitTimeSeconds:     aws.Int64(int64(s.waitTimeSeconds)),
-	})
-	if err != nil {
-		return nil, utils.NewInternalError(fmt.Errorf("error receiving messages: %w", err))
-	}
-
-	return res.Messages, nil
+func (s *QueueService) ReceiveNotifications(ctx context.Context) ([]ReceivedMessage, error) {
+	return s.queue.Receive(ctx, QueueNotification)
 }
 
-func (s *QueueService) DeleteMessage(queueType string, receiptHandle string) error {
-	var queueURL string
-
-	switch queueType {
-	case "transaction":
-		queueURL = s.transactionQueueURL
-	case "notification":
-		queueURL = s.notificationQueueURL
-	default:
-		return utils.NewInternalError(fmt.Errorf("unknown queue type: %s", queueType))
-	}
-
-	_, err := s.client.DeleteMessage(&sqs.DeleteMessageInput{
-		QueueUrl:      aws.String(queueURL),
-		ReceiptHandle: aws.String(receiptHandle),
-	})
-
-	if err != nil {
-		return utils.NewInternalError(fmt.Errorf("failed to delete message: %w", err))
-	}
+func (s *QueueService) DeleteMessage(ctx context.Context, queueType string, receiptHandle string) error {
+	return s.queue.Delete(ctx, queueType, receiptHandle)
+}
 
-	return nil
+func (s *QueueService) ChangeVisibility(ctx context.Context, queueType string, receiptHandle string, timeout time.Duration) error {
+	return s.queue.ChangeVisibility(ctx, queueType, receiptHandle, timeout)
 }
@@ -0,0 +1,35 @@
+package messenger
+
+import (
+	"context"
+	"testing"
+
+	"github.com/drmitchell85/finsys/internal/config"
+	"github.com/google/uuid"
+)
+
+func TestNotificationsDedupPerSubject(t *testing.T) {
+	ctx := context.Background()
+	qs := NewQueueService(NewMemoryQueue(config.SQSConfig{MaxNumberOfMessages: 10}))
+
+	userID := uuid.New()
+	first, second := uuid.NewString(), uuid.NewString()
+
+	// two failed transactions for one user, and a retry of the first
+	for _, subject := range []string{first, second, first} {
+		_, err := qs.EnqueueNotification(ctx, userID, "transaction_failed", "user@test.finsys", subject, map[string]any{
+			"transaction_id": subject,
+		})
+		if err != nil {
+			t.Fatalf("error enqueueing notification: %v", err)
+		}
+	}
+
+	msgs, err := qs.ReceiveNotifications(ctx)
+	if err != nil {
+		t.Fatalf("error receiving notifications: %v", err)
+	}
+	if len(msgs) != 2 {
+		t.Fatalf("got %d notifications, want one per failed transaction", len(msgs))
+	}
+}
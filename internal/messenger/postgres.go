@@ -0,0 +1,184 @@
+package messenger
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/drmitchell85/finsys/internal/config"
+	"github.com/drmitchell85/finsys/internal/utils"
+)
+
+// how often a waiting Receive rechecks an empty queue
+const postgresPollInterval = 500 * time.Millisecond
+
+// postgresQueue keeps messages in the queue_messages table and hands them
+// out with FOR UPDATE SKIP LOCKED, for environments without sqs. Dedup keys
+// are unique per queue for as long as the message hasn't been deleted.
+type postgresQueue struct {
+	db                *sql.DB
+	queueNames        map[string]string
+	maxMessages       int
+	wait              time.Duration
+	visibilityTimeout time.Duration
+	maxReceiveCount   int
+}
+
+func NewPostgresQueue(db *sql.DB, config config.SQSConfig) Queue {
+	return &postgresQueue{
+		db:                db,
+		queueNames:        queueNames(config),
+		maxMessages:       config.MaxNumberOfMessages,
+		wait:              time.Duration(config.WaitTimeSeconds) * time.Second,
+		visibilityTimeout: config.VisibilityTimeout,
+		maxReceiveCount:   config.MaxReceiveCount,
+	}
+}
+
+func (q *postgresQueue) getQueueName(queueType string) (string, error) {
+	name, ok := q.queueNames[queueType]
+	if !ok {
+		return "", utils.NewInternalError(fmt.Errorf("unknown queue type: %s", queueType))
+	}
+	return name, nil
+}
+
+func (q *postgresQueue) Enqueue(ctx context.Context, queueType string, body string, dedupKey string) (string, error) {
+	name, err := q.getQueueName(queueType)
+	if err != nil {
+		return "", err
+	}
+
+	var id int64
+	err = q.db.QueryRowContext(ctx, `
+        INSERT INTO queue_messages (queue, body, dedup_key) VALUES ($1, $2, $3)
+        ON CONFLICT (queue, dedup_key) DO UPDATE SET dedup_key = EXCLUDED.dedup_key
+        RETURNING id
+    `, name, body, dedupKey).Scan(&id)
+	if err != nil {
+		return "", utils.NewInternalError(fmt.Errorf("error sending message: %w", err))
+	}
+
+	return strconv.FormatInt(id, 10), nil
+}
+
+func (q *postgresQueue) Receive(ctx context.Context, queueType string) ([]ReceivedMessage, error) {
+	deadline := time.Now().Add(q.wait)
+
+	for {
+		msgs, err := q.receiveVisible(ctx, queueType)
+		if err != nil {
+			return nil, err
+		}
+		if len(msgs) > 0 || !time.Now().Before(deadline) {
+			return msgs, nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(postgresPollInterval):
+		}
+	}
+}
+
+func (q *postgresQueue) receiveVisible(ctx context.Context, queueType string) ([]ReceivedMessage, error) {
+	name, err := q.getQueueName(queueType)
+	if err != nil {
+		return nil, err
+	}
+
+	if dlq, ok := deadLetterQueueFor(queueType); ok && q.maxReceiveCount > 0 {
+		dlqName, err := q.getQueueName(dlq)
+		if err != nil {
+			return nil, err
+		}
+
+		// redrive messages that keep coming back, dropping the dedup key so
+		// they can't collide with anything already in the dlq
+		_, err = q.db.ExecContext(ctx, `
+            UPDATE queue_messages
+            SET queue = $1, dedup_key = NULL, receive_count = 0, receipt_handle = NULL
+            WHERE queue = $2 AND receive_count >= $3 AND visible_at <= NOW()
+        `, dlqName, name, q.maxReceiveCount)
+		if err != nil {
+			return nil, utils.NewInternalError(fmt.Errorf("error redriving messages: %w", err))
+		}
+	}
+
+	rows, err := q.db.QueryContext(ctx, `
+        UPDATE queue_messages
+        SET receipt_handle = gen_random_uuid(),
+            receive_count = receive_count + 1,
+            visible_at = NOW() + make_interval(secs => $3)
+        WHERE id IN (
+            SELECT id FROM queue_messages
+            WHERE queue = $1 AND visible_at <= NOW()
+            ORDER BY id
+            LIMIT $2
+            FOR UPDATE SKIP LOCKED
+        )
+        RETURNING id, receipt_handle, body, receive_count
+    `, name, q.maxMessages, q.visibilityTimeout.Seconds())
+	if err != nil {
+		return nil, utils.NewInternalError(fmt.Errorf("error receiving messages: %w", err))
+	}
+	defer rows.Close()
+
+	var msgs []ReceivedMessage
+	for rows.Next() {
+		var msg ReceivedMessage
+		if err := rows.Scan(&msg.ID, &msg.ReceiptHandle, &msg.Body, &msg.ReceiveCount); err != nil {
+			return nil, utils.NewInternalError(fmt.Errorf("error receiving messages: %w", err))
+		}
+		msgs = append(msgs, msg)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, utils.NewInternalError(fmt.Errorf("error receiving messages: %w", err))
+	}
+
+	return msgs, nil
+}
+
+func (q *postgresQueue) Delete(ctx context.Context, queueType string, receiptHandle string) error {
+	name, err := q.getQueueName(queueType)
+	if err != nil {
+		return err
+	}
+
+	res, err := q.db.ExecContext(ctx,
+		"DELETE FROM queue_messages WHERE queue = $1 AND receipt_handle = $2",
+		name, receiptHandle)
+	if err != nil {
+		return utils.NewInternalError(fmt.Errorf("failed to delete message: %w", err))
+	}
+
+	if rows, _ := res.RowsAffected(); rows == 0 {
+		return utils.NewInternalError(fmt.Errorf("failed to delete message: receipt handle %s not found", receiptHandle))
+	}
+
+	return nil
+}
+
+func (q *postgresQueue) ChangeVisibility(ctx context.Context, queueType string, receiptHandle string, timeout time.Duration) error {
+	name, err := q.getQueueName(queueType)
+	if err != nil {
+		return err
+	}
+
+	res, err := q.db.ExecContext(ctx,
+		"UPDATE queue_messages SET visible_at = NOW() + make_interval(secs => $1) WHERE queue = $2 AND receipt_handle = $3",
+		timeout.Seconds(), name, receiptHandle)
+	if err != nil {
+		return utils.NewInternalError(fmt.Errorf("failed to change message visibility: %w", err))
+	}
+
+	if rows, _ := res.RowsAffected(); rows == 0 {
+		return utils.NewInternalError(fmt.Errorf("failed to change message visibility: receipt handle %s not found", receiptHandle))
+	}
+
+	return nil
+}
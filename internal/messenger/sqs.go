@@ -0,0 +1,164 @@
+package messenger
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"github.com/drmitchell85/finsys/internal/config"
+	"github.com/drmitchell85/finsys/internal/utils"
+)
+
+type sqsQueue struct {
+	client              *sqs.SQS
+	queueURLs           map[string]string
+	maxNumberOfMessages int
+	waitTimeSeconds     int
+}
+
+func newSQSQueue(config config.Config) *sqsQueue {
+	client := initSQSClient(config)
+
+	// construct queue URLs - format differs between localstack and aws
+	prefix := ""
+	if os.Getenv("LOCAL_DEV") == "true" {
+		// localstack format: http://localhost:4566/000000000000/queue-name
+		prefix = fmt.Sprintf("%s/000000000000/", config.AWS.Host)
+	}
+
+	queueURLs := map[string]string{}
+	for queueType, name := range queueNames(config.SQS) {
+		queueURLs[queueType] = prefix + name
+	}
+
+	return &sqsQueue{
+		client:              client,
+		queueURLs:           queueURLs,
+		maxNumberOfMessages: config.SQS.MaxNumberOfMessages,
+		waitTimeSeconds:     config.SQS.WaitTimeSeconds,
+	}
+}
+
+func initSQSClient(config config.Config) *sqs.SQS {
+	var sess *session.Session
+
+	if os.Getenv("LOCAL_DEV") == "true" {
+		sess = session.Must(session.NewSessionWithOptions(session.Options{
+			Config: aws.Config{
+				Endpoint:    aws.String(config.AWS.Host),
+				Region:      aws.String(config.AWS.Region),
+				DisableSSL:  aws.Bool(true),
+				Credentials: credentials.NewStaticCredentials("test", "test", ""),
+			},
+		}))
+	} else {
+		sess = session.Must(session.NewSessionWithOptions(session.Options{
+			SharedConfigState: session.SharedConfigEnable,
+		}))
+	}
+
+	sqsClient := sqs.New(sess)
+
+	log.Println("connected to sqs")
+
+	return sqsClient
+}
+
+func (q *sqsQueue) getQueueURLForType(queueType string) (string, error) {
+	queueURL, ok := q.queueURLs[queueType]
+	if !ok {
+		return "", utils.NewInternalError(fmt.Errorf("unknown queue type: %s", queueType))
+	}
+	return queueURL, nil
+}
+
+func (q *sqsQueue) Enqueue(ctx context.Context, queueType string, body string, dedupKey string) (string, error) {
+	queueURL, err := q.getQueueURLForType(queueType)
+	if err != nil {
+		return "", err
+	}
+
+	res, err := q.client.SendMessageWithContext(ctx, &sqs.SendMessageInput{
+		QueueUrl:               aws.String(queueURL),
+		MessageBody:            aws.String(body),
+		MessageDeduplicationId: aws.String(dedupKey),  // for FIFO queues
+		MessageGroupId:         aws.String(queueType), // for FIFO queues
+	})
+	if err != nil {
+		return "", utils.WrapError(err, utils.ErrInternal, "error sending message")
+	}
+
+	return *res.MessageId, nil
+}
+
+func (q *sqsQueue) Receive(ctx context.Context, queueType string) ([]ReceivedMessage, error) {
+	queueURL, err := q.getQueueURLForType(queueType)
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := q.client.ReceiveMessageWithContext(ctx, &sqs.ReceiveMessageInput{
+		QueueUrl:            aws.String(queueURL),
+		AttributeNames:      aws.StringSlice([]string{"All"}),
+		MaxNumberOfMessages: aws.Int64(int64(q.maxNumberOfMessages)),
+		WaitTimeSeconds:     aws.Int64(int64(q.waitTimeSeconds)),
+	})
+	if err != nil {
+		return nil, utils.NewInternalError(fmt.Errorf("error receiving messages: %w", err))
+	}
+
+	msgs := make([]ReceivedMessage, 0, len(res.Messages))
+	for _, m := range res.Messages {
+		receiveCount, _ := strconv.Atoi(aws.StringValue(m.Attributes[sqs.MessageSystemAttributeNameApproximateReceiveCount]))
+		msgs = append(msgs, ReceivedMessage{
+			ID:            aws.StringValue(m.MessageId),
+			ReceiptHandle: aws.StringValue(m.ReceiptHandle),
+			Body:          aws.StringValue(m.Body),
+			ReceiveCount:  receiveCount,
+		})
+	}
+
+	return msgs, nil
+}
+
+func (q *sqsQueue) Delete(ctx context.Context, queueType string, receiptHandle string) error {
+	queueURL, err := q.getQueueURLForType(queueType)
+	if err != nil {
+		return err
+	}
+
+	_, err = q.client.DeleteMessageWithContext(ctx, &sqs.DeleteMessageInput{
+		QueueUrl:      aws.String(queueURL),
+		ReceiptHandle: aws.String(receiptHandle),
+	})
+	if err != nil {
+		return utils.NewInternalError(fmt.Errorf("failed to delete message: %w", err))
+	}
+
+	return nil
+}
+
+func (q *sqsQueue) ChangeVisibility(ctx context.Context, queueType string, receiptHandle string, timeout time.Duration) error {
+	queueURL, err := q.getQueueURLForType(queueType)
+	if err != nil {
+		return err
+	}
+
+	_, err = q.client.ChangeMessageVisibilityWithContext(ctx, &sqs.ChangeMessageVisibilityInput{
+		QueueUrl:          aws.String(queueURL),
+		ReceiptHandle:     aws.String(receiptHandle),
+		VisibilityTimeout: aws.Int64(int64(timeout.Seconds())),
+	})
+	if err != nil {
+		return utils.NewInternalError(fmt.Errorf("failed to change message visibility: %w", err))
+	}
+
+	return nil
+}
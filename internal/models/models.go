@@ -15,6 +15,7 @@ const (
 	TransactionProcessing TransactionStatus = "processing"
 	TransactionCompleted  TransactionStatus = "completed"
 	TransactionFailed     TransactionStatus = "failed"
+	TransactionCancelled  TransactionStatus = "cancelled"
 )
 
 type Message struct {
@@ -24,11 +25,16 @@ type Message struct {
 	Timestamp int64           `json:"timestamp"` // unix timestamp when created
 }
 
+// operations carried by a TransactionPayload
+const (
+	OperationProcess = "process"
+)
+
 // Type-specific payloads
 type TransactionPayload struct {
 	TransactionID  uuid.UUID `json:"transaction_id"`
 	IdempotencyKey string    `json:"idempotency_key"`
-	Operation      string    `json:"operation"` // "process", "refund", etc.
+	Operation      string    `json:"operation"` // "process"
 }
 
 type NotificationPayload struct {
@@ -38,6 +44,26 @@ type NotificationPayload struct {
 	Data        any       `json:"data"`        // template data
 }
 
+// OutboxMessage is a queue message written in the same db transaction as the
+// change that produced it, waiting to be relayed to the queue
+type OutboxMessage struct {
+	ID          int64           `json:"id"`
+	MessageType string          `json:"message_type"`
+	Payload     json.RawMessage `json:"payload"`
+	DedupKey    string          `json:"dedup_key"`
+	Attempts    int             `json:"attempts"`
+	CreatedAt   time.Time       `json:"created_at"`
+}
+
+// ProviderEvent is a provider webhook applied to a transaction, kept so
+// redeliveries of it are dropped
+type ProviderEvent struct {
+	Provider      string    `json:"provider"`
+	EventID       string    `json:"event_id"`
+	Type          string    `json:"type"`
+	TransactionID uuid.UUID `json:"transaction_id"`
+}
+
 type Transaction struct {
 	ID             uuid.UUID         `json:"id,omitempty"`
 	IdempotencyKey string            `json:"idempotency_key" validate:"required"`
@@ -49,6 +75,32 @@ type Transaction struct {
 	CreatedAt      time.Time         `json:"created_at,omitempty"` // add these
 	UpdatedAt      time.Time         `json:"updated_at,omitempty"`
 	ReservationID  uuid.UUID         `json:"bank_reservation_id" validate:"required"`
+	HoldExpiresAt  *time.Time        `json:"reservation_expires_at,omitempty"` // when the provider drops the reservation
+	ProviderName   string            `json:"provider_name,omitempty"`
+	ProviderRef    string            `json:"external_provider_id,omitempty"` // the provider's reference for the funds
+	Description    string            `json:"description,omitempty"`
+	Metadata       map[string]any    `json:"metadata,omitempty"`
+	LockToken      int64             `json:"-"` // fencing token of the account lock held while creating
+	RequestHash    string            `json:"-"` // fingerprint of the request that created it
+	ClientID       string            `json:"-"` // namespace the idempotency key belongs to
+}
+
+type AccountOwner struct {
+	AccountID uuid.UUID `json:"account_id"`
+	UserID    uuid.UUID `json:"user_id"`
+	Email     string    `json:"email"`
+}
+
+type APIKey struct {
+	ID         uuid.UUID  `json:"id"`
+	UserID     uuid.UUID  `json:"user_id"`
+	Name       string     `json:"name"`
+	Prefix     string     `json:"prefix"`
+	Scopes     []string   `json:"scopes"`
+	Status     string     `json:"status"` // active/revoked
+	ExpiresAt  *time.Time `json:"expires_at,omitempty"`
+	LastUsedAt *time.Time `json:"last_used_at,omitempty"`
+	CreatedAt  time.Time  `json:"created_at"`
 }
 
 type IdempotencyCache struct {
@@ -57,7 +109,12 @@ type IdempotencyCache struct {
 	Response      json.RawMessage   `json:"response"` // the actual API response
 	CreatedAt     time.Time         `json:"created_at"`
 	CompletedAt   *time.Time        `json:"completed_at,omitempty"`
+	ErrorStatus   int               `json:"error_status,omitempty"` // set when the request failed for good
+	ErrorCode     string            `json:"error_code,omitempty"`
 	ErrorMessage  string            `json:"error_message,omitempty"`
+	ErrorDetails  map[string]any    `json:"error_details,omitempty"`
+	RequestHash   string            `json:"request_hash,omitempty"`   // fingerprint of the request the key was first used with
+	RequestFields map[string]string `json:"request_fields,omitempty"` // digest per field, to report what changed
 }
 
 type CreateTransactionRequest struct {
@@ -68,10 +125,34 @@ type CreateTransactionRequest struct {
 	Currency       string          `json:"currency" validate:"required,len=3"`
 	Description    string          `json:"description,omitempty"`
 	Metadata       map[string]any  `json:"metadata,omitempty"`
+	ClientID       string          `json:"-"` // set from the authenticated caller, scopes the idempotency key
 }
 
 type CreateTransactionResponse struct {
 	TransactionID uuid.UUID         `json:"transaction_id"`
 	Status        TransactionStatus `json:"status"`
 	CreatedAt     time.Time         `json:"created_at"`
+	Replayed      bool              `json:"-"` // served from a previous request with the same idempotency key
+}
+
+// TransactionCursor marks the last row of a page, ordered by created_at, id
+type TransactionCursor struct {
+	CreatedAt time.Time `json:"created_at"`
+	ID        uuid.UUID `json:"id"`
+}
+
+type TransactionFilter struct {
+	AccountID     uuid.UUID          // matches either side of the transaction
+	Status        *TransactionStatus // optional
+	CreatedAfter  *time.Time         // optional, inclusive
+	CreatedBefore *time.Time         // optional, exclusive
+	Cursor        *TransactionCursor // optional, start after this row
+	Metadata      map[string]string  // optional, every pair must match, numbers and booleans by value
+	Limit         int
+}
+
+type ListTransactionsResponse struct {
+	Transactions []Transaction `json:"transactions"`
+	NextCursor   string        `json:"next_cursor,omitempty"`
+	HasMore      bool          `json:"has_more"`
 }
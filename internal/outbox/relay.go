@@ -0,0 +1,105 @@
+package outbox
+
+import (
+	"context"
+	"log/slog"
+	"math"
+	"time"
+
+	"github.com/drmitchell85/finsys/internal/config"
+	"github.com/drmitchell85/finsys/internal/messenger"
+	"github.com/drmitchell85/finsys/internal/models"
+	"github.com/drmitchell85/finsys/internal/store"
+)
+
+// first retry delay after a failed publish, doubled on every attempt
+const baseBackoff = time.Second
+
+// Relay publishes rows from the outbox table to the queue. Several relays can
+// run side by side since each batch is claimed with SKIP LOCKED.
+type Relay struct {
+	rs     store.RepositoryService
+	qs     *messenger.QueueService
+	logger *slog.Logger
+	config config.OutboxConfig
+}
+
+func NewRelay(rs store.RepositoryService, qs *messenger.QueueService, logger *slog.Logger, config config.OutboxConfig) *Relay {
+	return &Relay{
+		rs:     rs,
+		qs:     qs,
+		logger: logger,
+		config: config,
+	}
+}
+
+// Run polls the outbox until ctx is cancelled
+func (r *Relay) Run(ctx context.Context) {
+	ticker := time.NewTicker(r.config.PollInterval)
+	defer ticker.Stop()
+
+	for {
+		// keep draining while full batches come back
+		for {
+			sent, err := r.publishBatch(ctx)
+			if err != nil {
+				r.logger.Error("error relaying outbox", "error", err)
+				break
+			}
+			if sent < r.config.BatchSize {
+				break
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// publishBatch claims a batch and publishes it, returning how many were claimed
+func (r *Relay) publishBatch(ctx context.Context) (int, error) {
+	msgs, err := r.rs.ClaimOutboxMessages(ctx, r.config.BatchSize, r.config.Lease)
+	if err != nil {
+		return 0, err
+	}
+
+	for _, msg := range msgs {
+		r.publish(ctx, msg)
+	}
+
+	return len(msgs), nil
+}
+
+func (r *Relay) publish(ctx context.Context, msg models.OutboxMessage) {
+	_, err := r.qs.EnqueueMessage(ctx, msg.MessageType, msg.Payload, msg.DedupKey)
+	if err != nil {
+		retryIn := backoff(msg.Attempts, r.config.MaxBackoff)
+		r.logger.Warn("error publishing outbox message",
+			"outbox_id", msg.ID,
+			"attempts", msg.Attempts,
+			"retry_in", retryIn,
+			"error", err)
+
+		if err := r.rs.MarkOutboxFailed(ctx, msg.ID, err.Error(), retryIn); err != nil {
+			// the lease expires on its own, so it'll be picked up again anyway
+			r.logger.Error("error recording outbox failure", "outbox_id", msg.ID, "error", err)
+		}
+		return
+	}
+
+	if err := r.rs.MarkOutboxSent(ctx, msg.ID); err != nil {
+		// the message goes out again after the lease, processing is idempotent
+		r.logger.Error("error marking outbox message sent", "outbox_id", msg.ID, "error", err)
+	}
+}
+
+func backoff(attempts int, max time.Duration) time.Duration {
+	delay := time.Duration(float64(baseBackoff) * math.Pow(2, float64(attempts-1)))
+	if delay <= 0 || delay > max {
+		return max
+	}
+	return delay
+}
@@ -0,0 +1,139 @@
+package ratelimit
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/drmitchell85/finsys/internal/utils"
+	"github.com/google/uuid"
+	"github.com/redis/go-redis/v9"
+)
+
+type Limit struct {
+	Requests int
+	Window   time.Duration
+}
+
+type Result struct {
+	Allowed    bool
+	Limit      int
+	Remaining  int
+	RetryAfter time.Duration // until a slot frees up, zero when allowed
+	ResetAfter time.Duration // until the window is empty again
+}
+
+// Check is one window a request is counted against
+type Check struct {
+	Key   string
+	Limit Limit
+}
+
+type Limiter interface {
+	// Allow admits the request only if every check has room, and only then
+	// counts it against all of them. Results are in the order of checks.
+	Allow(ctx context.Context, checks ...Check) ([]*Result, error)
+}
+
+// slidingWindow keeps a sorted set of request timestamps per key. Entries
+// older than the window are trimmed on every call, and a request is only
+// recorded when every window allows it, so rejected retries don't extend
+// the lockout and a request refused by one limit doesn't use up the others.
+var slidingWindow = redis.NewScript(`
+local now = tonumber(ARGV[1])
+local member = ARGV[2]
+
+local counts = {}
+local admit = 1
+for i, key in ipairs(KEYS) do
+    local window = tonumber(ARGV[2 * i + 1])
+    local limit = tonumber(ARGV[2 * i + 2])
+
+    redis.call('ZREMRANGEBYSCORE', key, '-inf', now - window)
+    counts[i] = redis.call('ZCARD', key)
+    if counts[i] >= limit then
+        admit = 0
+    end
+end
+
+local results = {}
+for i, key in ipairs(KEYS) do
+    local window = tonumber(ARGV[2 * i + 1])
+    local limit = tonumber(ARGV[2 * i + 2])
+
+    local allowed = 0
+    if counts[i] < limit then
+        allowed = 1
+    end
+
+    if admit == 1 then
+        redis.call('ZADD', key, now, member)
+        redis.call('PEXPIRE', key, window)
+        counts[i] = counts[i] + 1
+    end
+
+    local oldest = redis.call('ZRANGE', key, 0, 0, 'WITHSCORES')
+    local reset = 0
+    if oldest[2] then
+        reset = tonumber(oldest[2]) + window - now
+    end
+
+    table.insert(results, allowed)
+    table.insert(results, counts[i])
+    table.insert(results, reset)
+end
+
+return results
+`)
+
+type redisLimiter struct {
+	redis *redis.Client
+}
+
+func NewLimiter(redis *redis.Client) Limiter {
+	return &redisLimiter{
+		redis: redis,
+	}
+}
+
+func (rl *redisLimiter) Allow(ctx context.Context, checks ...Check) ([]*Result, error) {
+	if len(checks) == 0 {
+		return nil, nil
+	}
+
+	now := time.Now().UnixMilli()
+
+	keys := make([]string, 0, len(checks))
+	args := []any{now, fmt.Sprintf("%d-%s", now, uuid.NewString())}
+	for _, check := range checks {
+		keys = append(keys, "ratelimit:"+check.Key)
+		args = append(args, check.Limit.Window.Milliseconds(), check.Limit.Requests)
+	}
+
+	res, err := slidingWindow.Run(ctx, rl.redis, keys, args...).Int64Slice()
+	if err != nil {
+		return nil, utils.NewInternalError(fmt.Errorf("error checking rate limit: %w", err))
+	}
+	if len(res) != 3*len(checks) {
+		return nil, utils.NewInternalError(fmt.Errorf("rate limit script returned %d values for %d checks", len(res), len(checks)))
+	}
+
+	results := make([]*Result, 0, len(checks))
+	for i, check := range checks {
+		allowed, count, reset := res[3*i] == 1, int(res[3*i+1]), time.Duration(res[3*i+2])*time.Millisecond
+
+		result := &Result{
+			Allowed:    allowed,
+			Limit:      check.Limit.Requests,
+			Remaining:  max(check.Limit.Requests-count, 0),
+			ResetAfter: reset,
+		}
+		if !allowed {
+			// the oldest request dropping out of the window frees the next slot
+			result.RetryAfter = reset
+		}
+		results = append(results, result)
+	}
+
+	return results, nil
+}
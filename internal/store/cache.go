@@ -0,0 +1,145 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"sync/atomic"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// ErrCacheUnavailable is returned straight away for redis commands while the
+// cache is down, instead of every request waiting out a dial timeout
+var ErrCacheUnavailable = errors.New("cache unavailable")
+
+// probeTimeout bounds a single health check ping
+const probeTimeout = time.Second
+
+type probeKey struct{}
+
+// CacheMonitor tracks whether redis is reachable. It pings in the background
+// and, while redis is down, short circuits commands on the client with
+// ErrCacheUnavailable so callers can fall back.
+type CacheMonitor struct {
+	redis    *redis.Client
+	interval time.Duration
+	healthy  atomic.Bool
+}
+
+func NewCacheMonitor(rds *redis.Client, interval time.Duration) *CacheMonitor {
+	m := &CacheMonitor{
+		redis:    rds,
+		interval: interval,
+	}
+	rds.AddHook(m)
+
+	// InitCache already logged how the first connection went
+	m.healthy.Store(m.ping(context.Background()) == nil)
+
+	return m
+}
+
+func (m *CacheMonitor) Healthy() bool {
+	return m.healthy.Load()
+}
+
+// Run keeps probing redis until ctx is done
+func (m *CacheMonitor) Run(ctx context.Context) {
+	ticker := time.NewTicker(m.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			m.probe(ctx)
+		}
+	}
+}
+
+func (m *CacheMonitor) ping(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(context.WithValue(ctx, probeKey{}, true), probeTimeout)
+	defer cancel()
+
+	return m.redis.Ping(ctx).Err()
+}
+
+func (m *CacheMonitor) probe(ctx context.Context) {
+	err := m.ping(ctx)
+	if err != nil {
+		m.markDown(err)
+		return
+	}
+
+	if !m.healthy.Swap(true) {
+		log.Println("reconnected to cache")
+	}
+}
+
+func (m *CacheMonitor) markDown(err error) {
+	if m.healthy.Swap(false) {
+		log.Printf("WARN: cache unavailable, running degraded: %v", err)
+	}
+}
+
+func (m *CacheMonitor) DialHook(next redis.DialHook) redis.DialHook {
+	return next
+}
+
+func (m *CacheMonitor) ProcessHook(next redis.ProcessHook) redis.ProcessHook {
+	return func(ctx context.Context, cmd redis.Cmder) error {
+		if !m.Healthy() && ctx.Value(probeKey{}) == nil {
+			cmd.SetErr(ErrCacheUnavailable)
+			return ErrCacheUnavailable
+		}
+
+		err := next(ctx, cmd)
+		if isConnError(err) {
+			m.markDown(err)
+			err = unavailable(err)
+			cmd.SetErr(err)
+		}
+		return err
+	}
+}
+
+func (m *CacheMonitor) ProcessPipelineHook(next redis.ProcessPipelineHook) redis.ProcessPipelineHook {
+	return func(ctx context.Context, cmds []redis.Cmder) error {
+		if !m.Healthy() {
+			for _, cmd := range cmds {
+				cmd.SetErr(ErrCacheUnavailable)
+			}
+			return ErrCacheUnavailable
+		}
+
+		err := next(ctx, cmds)
+		if isConnError(err) {
+			m.markDown(err)
+			for _, cmd := range cmds {
+				if isConnError(cmd.Err()) {
+					cmd.SetErr(unavailable(cmd.Err()))
+				}
+			}
+			err = unavailable(err)
+		}
+		return err
+	}
+}
+
+// unavailable marks a failure reaching redis as ErrCacheUnavailable, so the
+// request that finds redis down falls back like the ones after it
+func unavailable(err error) error {
+	return fmt.Errorf("%w: %w", ErrCacheUnavailable, err)
+}
+
+// isConnError is true for failures reaching redis, not for replies like
+// redis.Nil or script errors
+func isConnError(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr)
+}
@@ -0,0 +1,60 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+
+	"github.com/redis/go-redis/v9"
+)
+
+func TestConnErrorReturnsCacheUnavailable(t *testing.T) {
+	m := &CacheMonitor{}
+	m.healthy.Store(true)
+
+	calls := 0
+	process := m.ProcessHook(func(ctx context.Context, cmd redis.Cmder) error {
+		calls++
+		err := &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")}
+		cmd.SetErr(err)
+		return err
+	})
+
+	// the request that finds redis down falls back too
+	cmd := redis.NewStatusCmd(context.Background(), "ping")
+	err := process(context.Background(), cmd)
+	if !errors.Is(err, ErrCacheUnavailable) || !errors.Is(cmd.Err(), ErrCacheUnavailable) {
+		t.Fatalf("want ErrCacheUnavailable on first failure, got %v", err)
+	}
+	if m.Healthy() {
+		t.Fatal("cache still marked healthy after a connection error")
+	}
+
+	// and the ones after it don't reach redis
+	err = process(context.Background(), redis.NewStatusCmd(context.Background(), "ping"))
+	if !errors.Is(err, ErrCacheUnavailable) {
+		t.Fatalf("want ErrCacheUnavailable while down, got %v", err)
+	}
+	if calls != 1 {
+		t.Fatalf("redis called %d times, want 1", calls)
+	}
+}
+
+func TestReplyErrorKeepsCacheHealthy(t *testing.T) {
+	m := &CacheMonitor{}
+	m.healthy.Store(true)
+
+	process := m.ProcessHook(func(ctx context.Context, cmd redis.Cmder) error {
+		cmd.SetErr(redis.Nil)
+		return redis.Nil
+	})
+
+	err := process(context.Background(), redis.NewStringCmd(context.Background(), "get", "missing"))
+	if !errors.Is(err, redis.Nil) {
+		t.Fatalf("want redis.Nil, got %v", err)
+	}
+	if !m.Healthy() {
+		t.Fatal("a reply error marked the cache down")
+	}
+}
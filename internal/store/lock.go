@@ -0,0 +1,162 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/drmitchell85/finsys/internal/utils"
+	"github.com/google/uuid"
+	"github.com/redis/go-redis/v9"
+)
+
+// bounds on how often a waiting Acquire retries a held lock
+const (
+	lockRetryMin = 20 * time.Millisecond
+	lockRetryMax = 250 * time.Millisecond
+)
+
+// only touch the lock if we still own it
+var (
+	renewLock = redis.NewScript(`
+if redis.call('GET', KEYS[1]) == ARGV[1] then
+    return redis.call('PEXPIRE', KEYS[1], ARGV[2])
+end
+return 0
+`)
+
+	releaseLock = redis.NewScript(`
+if redis.call('GET', KEYS[1]) == ARGV[1] then
+    return redis.call('DEL', KEYS[1])
+end
+return 0
+`)
+)
+
+type Locker interface {
+	Acquire(ctx context.Context, key string, ttl time.Duration, wait time.Duration) (*Lock, error)
+}
+
+// Lock is a held redis lock, kept alive in the background until released.
+// Token is a fencing token that only goes up, so anything written under the
+// lock can reject a holder that lost it to someone newer. It comes from
+// postgres, so it keeps going up if redis loses its data.
+type Lock struct {
+	Token int64
+
+	redis *redis.Client
+	key   string
+	owner string
+	ttl   time.Duration
+	stop  chan struct{}
+	wg    sync.WaitGroup
+}
+
+type redisLocker struct {
+	redis *redis.Client
+	db    *sql.DB
+}
+
+func NewLocker(redis *redis.Client, db *sql.DB) Locker {
+	return &redisLocker{
+		redis: redis,
+		db:    db,
+	}
+}
+
+// Acquire takes the lock, retrying for up to wait before giving up with a
+// retryable ErrLockTimeout
+func (rl *redisLocker) Acquire(ctx context.Context, key string, ttl time.Duration, wait time.Duration) (*Lock, error) {
+	lockKey := "lock:" + key
+	owner := uuid.NewString()
+	deadline := time.Now().Add(wait)
+	retry := lockRetryMin
+
+	for {
+		ok, err := rl.redis.SetNX(ctx, lockKey, owner, ttl).Result()
+		if err != nil {
+			return nil, utils.NewInternalError(fmt.Errorf("error acquiring lock %s: %w", key, err))
+		}
+		if ok {
+			break
+		}
+
+		if !time.Now().Add(retry).Before(deadline) {
+			return nil, utils.NewLockTimeoutError("resource is busy, try again", fmt.Errorf("timed out after %s waiting for lock %s", wait, key))
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, utils.NewInternalError(ctx.Err())
+		case <-time.After(retry):
+		}
+		retry = min(retry*2, lockRetryMax)
+	}
+
+	// taken after winning the lock, so tokens follow acquisition order
+	var token int64
+	err := rl.db.QueryRowContext(ctx, "SELECT nextval('lock_fence_seq')").Scan(&token)
+	if err != nil {
+		releaseLock.Run(ctx, rl.redis, []string{lockKey}, owner)
+		return nil, utils.NewInternalError(fmt.Errorf("error issuing fencing token for %s: %w", key, err))
+	}
+
+	lock := &Lock{
+		Token: token,
+		redis: rl.redis,
+		key:   lockKey,
+		owner: owner,
+		ttl:   ttl,
+		stop:  make(chan struct{}),
+	}
+
+	lock.wg.Add(1)
+	go lock.keepAlive()
+
+	return lock, nil
+}
+
+// keepAlive extends the ttl while the holder is still working
+func (l *Lock) keepAlive() {
+	defer l.wg.Done()
+
+	ticker := time.NewTicker(l.ttl / 3)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-l.stop:
+			return
+		case <-ticker.C:
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), l.ttl/3)
+		renewed, err := renewLock.Run(ctx, l.redis, []string{l.key}, l.owner, l.ttl.Milliseconds()).Int()
+		cancel()
+
+		if err != nil {
+			log.Printf("WARN: error renewing lock %s: %v", l.key, err)
+			continue
+		}
+		if renewed == 0 {
+			// someone else holds it now, the fencing token protects the writes
+			log.Printf("WARN: lost lock %s", l.key)
+			return
+		}
+	}
+}
+
+func (l *Lock) Release(ctx context.Context) error {
+	close(l.stop)
+	l.wg.Wait()
+
+	err := releaseLock.Run(ctx, l.redis, []string{l.key}, l.owner).Err()
+	if err != nil {
+		return utils.NewInternalError(fmt.Errorf("error releasing lock %s: %w", l.key, err))
+	}
+
+	return nil
+}
@@ -0,0 +1,123 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/drmitchell85/finsys/internal/utils"
+	"github.com/google/uuid"
+	_ "github.com/lib/pq"
+	"github.com/redis/go-redis/v9"
+)
+
+// testDeps connects to the postgres and redis named in the environment.
+// Both are written to and the redis db is flushed, so point them at
+// throwaway instances with db.sql applied.
+func testDeps(t *testing.T) (*sql.DB, *redis.Client) {
+	t.Helper()
+
+	dsn := os.Getenv("FINSYS_TEST_DATABASE_URL")
+	addr := os.Getenv("FINSYS_TEST_REDIS_ADDR")
+	if dsn == "" || addr == "" {
+		t.Skip("FINSYS_TEST_DATABASE_URL and FINSYS_TEST_REDIS_ADDR not set")
+	}
+
+	db, err := sql.Open("postgres", dsn)
+	if err != nil {
+		t.Fatalf("error opening db: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	rds := redis.NewClient(&redis.Options{Addr: addr})
+	t.Cleanup(func() { rds.Close() })
+
+	return db, rds
+}
+
+// createTestAccount inserts an account with its owner, removed when the test ends
+func createTestAccount(t *testing.T, db *sql.DB) uuid.UUID {
+	t.Helper()
+
+	var userID, accountID uuid.UUID
+	err := db.QueryRow(
+		"INSERT INTO users (email) VALUES ($1) RETURNING id",
+		uuid.NewString()+"@test.finsys").Scan(&userID)
+	if err != nil {
+		t.Fatalf("error creating user: %v", err)
+	}
+
+	err = db.QueryRow(
+		"INSERT INTO accounts (user_id, account_type) VALUES ($1, 'customer') RETURNING id",
+		userID).Scan(&accountID)
+	if err != nil {
+		t.Fatalf("error creating account: %v", err)
+	}
+
+	t.Cleanup(func() {
+		db.Exec("DELETE FROM accounts WHERE id = $1", accountID)
+		db.Exec("DELETE FROM users WHERE id = $1", userID)
+	})
+
+	return accountID
+}
+
+func writeLockToken(ctx context.Context, db *sql.DB, accountID uuid.UUID, token int64) error {
+	dbtx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer dbtx.Rollback()
+
+	if err := checkLockToken(ctx, dbtx, accountID, token); err != nil {
+		return err
+	}
+
+	return dbtx.Commit()
+}
+
+func TestLockTokenSurvivesRedisReset(t *testing.T) {
+	db, rds := testDeps(t)
+	ctx := context.Background()
+
+	accountID := createTestAccount(t, db)
+	locker := NewLocker(rds, db)
+	key := "account:" + accountID.String()
+
+	first, err := locker.Acquire(ctx, key, time.Second, time.Second)
+	if err != nil {
+		t.Fatalf("error acquiring lock: %v", err)
+	}
+	if err := writeLockToken(ctx, db, accountID, first.Token); err != nil {
+		t.Fatalf("first holder rejected: %v", err)
+	}
+	if err := first.Release(ctx); err != nil {
+		t.Fatalf("error releasing lock: %v", err)
+	}
+
+	// redis restarting empty loses every lock key
+	if err := rds.FlushDB(ctx).Err(); err != nil {
+		t.Fatalf("error flushing redis: %v", err)
+	}
+
+	second, err := locker.Acquire(ctx, key, time.Second, time.Second)
+	if err != nil {
+		t.Fatalf("error acquiring lock after reset: %v", err)
+	}
+	defer second.Release(ctx)
+
+	if second.Token <= first.Token {
+		t.Fatalf("token went backwards after reset: %d then %d", first.Token, second.Token)
+	}
+	if err := writeLockToken(ctx, db, accountID, second.Token); err != nil {
+		t.Fatalf("holder after reset rejected: %v", err)
+	}
+
+	// the earlier holder is still fenced off
+	err = writeLockToken(ctx, db, accountID, first.Token)
+	if appErr, ok := utils.GetAppError(err); !ok || appErr.Code != utils.ErrLockTimeout {
+		t.Fatalf("stale token accepted, got %v", err)
+	}
+}
@@ -5,11 +5,14 @@ import (
 	"database/sql"
 	"encoding/json"
 	"fmt"
+	"strings"
 	"time"
 
+	"github.com/drmitchell85/finsys/internal/ledger"
 	"github.com/drmitchell85/finsys/internal/models"
 	"github.com/drmitchell85/finsys/internal/utils"
 	"github.com/google/uuid"
+	"github.com/lib/pq"
 	"github.com/redis/go-redis/v9"
 )
 
@@ -18,9 +21,28 @@ type RepositoryService interface {
 	CheckIdempotencyKey(ctx context.Context, ikey string) (string, error)
 	StoreIdempotencyKey(ctx context.Context, key string, data *models.IdempotencyCache, expiration time.Duration) error
 	GetIdempotencyCache(ctx context.Context, key string) (*models.IdempotencyCache, error)
-	GetTransactionByIdempotencyKey(ctx context.Context, idempKey string) (*models.Transaction, error)
+	MarkIdempotencyInFlight(ctx context.Context, key string, expiration time.Duration) (bool, error)
+	ClearIdempotencyInFlight(ctx context.Context, key string) error
+	GetTransactionByIdempotencyKey(ctx context.Context, clientID string, idempKey string) (*models.Transaction, error)
 	CreateTransaction(ctx context.Context, tx *models.Transaction) (uuid.UUID, time.Time, error)
+	GetTransactionByID(ctx context.Context, txID uuid.UUID) (*models.Transaction, error)
+	GetTransactionByProviderRef(ctx context.Context, provider string, ref string) (*models.Transaction, error)
+	ListTransactions(ctx context.Context, filter models.TransactionFilter) ([]models.Transaction, error)
+	ListTransactionsWithExpiredReservations(ctx context.Context, limit int, retryAfter time.Duration) ([]models.Transaction, error)
+	MarkExpiryAttempted(ctx context.Context, txID uuid.UUID) error
+	TransitionTransaction(ctx context.Context, txID uuid.UUID, from models.TransactionStatus, to models.TransactionStatus, reason string) error
+	TransitionTransactionForEvent(ctx context.Context, event models.ProviderEvent, from models.TransactionStatus, to models.TransactionStatus, reason string) error
 	GetExternalBankAccountID(ctx context.Context, accountID uuid.UUID) (uuid.UUID, error)
+	GetAccountOwner(ctx context.Context, accountID uuid.UUID) (*models.AccountOwner, error)
+	CreateAPIKey(ctx context.Context, key *models.APIKey, keyHash string) error
+	GetAPIKeyByHash(ctx context.Context, keyHash string) (*models.APIKey, error)
+	ClaimOutboxMessages(ctx context.Context, limit int, lease time.Duration) ([]models.OutboxMessage, error)
+	MarkOutboxSent(ctx context.Context, id int64) error
+	MarkOutboxFailed(ctx context.Context, id int64, reason string, retryIn time.Duration) error
+	ClaimProviderEvent(ctx context.Context, provider string, eventID string, expiration time.Duration) (bool, error)
+	ReleaseProviderEvent(ctx context.Context, provider string, eventID string) error
+	ProviderEventExists(ctx context.Context, provider string, eventID string) (bool, error)
+	RecordProviderEvent(ctx context.Context, event models.ProviderEvent) error
 }
 
 type repositoryService struct {
@@ -94,15 +116,42 @@ func (rs *repositoryService) GetIdempotencyCache(ctx context.Context, key string
 	return &cache, nil
 }
 
-func (rs *repositoryService) GetTransactionByIdempotencyKey(ctx context.Context, idempKey string) (*models.Transaction, error) {
-	tx := &models.Transaction{}
+// MarkIdempotencyInFlight claims a key for the request about to do the work,
+// false means another request with the same key got there first
+func (rs *repositoryService) MarkIdempotencyInFlight(ctx context.Context, key string, expiration time.Duration) (bool, error) {
+	ok, err := rs.redis.SetNX(ctx, "inflight:"+key, time.Now().Unix(), expiration).Result()
+	if err != nil {
+		return false, utils.NewInternalError(fmt.Errorf("error marking key in flight: %w", err))
+	}
 
-	query := `SELECT id, idempotency_key, from_account_id, to_account_id, amount, currency, status, created_at, updated_at 
-              FROM transactions 
-              WHERE idempotency_key = $1 
-              LIMIT 1`
+	return ok, nil
+}
+
+func (rs *repositoryService) ClearIdempotencyInFlight(ctx context.Context, key string) error {
+	err := rs.redis.Del(ctx, "inflight:"+key).Err()
+	if err != nil {
+		return utils.NewInternalError(fmt.Errorf("error clearing in flight key: %w", err))
+	}
 
-	err := rs.db.QueryRowContext(ctx, query, idempKey).Scan(
+	return nil
+}
+
+// transactionColumns is the column list scanTransaction expects
+const transactionColumns = `id, idempotency_key, from_account_id, to_account_id, amount, currency, status, created_at, updated_at, bank_reservation_id, description, metadata, request_hash, client_id, provider_name, external_provider_id, reservation_expires_at`
+
+// rowScanner is satisfied by both *sql.Row and *sql.Rows
+type rowScanner interface {
+	Scan(dest ...any) error
+}
+
+func scanTransaction(row rowScanner, tx *models.Transaction) error {
+	var description sql.NullString
+	var metadata []byte
+	var requestHash sql.NullString
+	var clientID sql.NullString
+	var providerName, providerRef sql.NullString
+
+	err := row.Scan(
 		&tx.ID,
 		&tx.IdempotencyKey,
 		&tx.FromAccountID,
@@ -112,8 +161,76 @@ func (rs *repositoryService) GetTransactionByIdempotencyKey(ctx context.Context,
 		&tx.Status,
 		&tx.CreatedAt,
 		&tx.UpdatedAt,
+		&tx.ReservationID,
+		&description,
+		&metadata,
+		&requestHash,
+		&clientID,
+		&providerName,
+		&providerRef,
+		&tx.HoldExpiresAt,
 	)
+	if err != nil {
+		return err
+	}
+
+	tx.Description = description.String
+	tx.RequestHash = requestHash.String
+	tx.ClientID = clientID.String
+	tx.ProviderName = providerName.String
+	tx.ProviderRef = providerRef.String
+	if metadata != nil {
+		if err := json.Unmarshal(metadata, &tx.Metadata); err != nil {
+			return fmt.Errorf("error unmarshaling metadata: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// metadataValues is what a metadata filter value can match, the string
+// itself and the number or boolean it spells, if any
+func metadataValues(value string) []any {
+	values := []any{value}
+
+	dec := json.NewDecoder(strings.NewReader(value))
+	dec.UseNumber()
+
+	var v any
+	if dec.Decode(&v) != nil || dec.More() {
+		return values
+	}
+	switch v.(type) {
+	case json.Number, bool:
+		values = append(values, v)
+	}
+
+	return values
+}
+
+// nullableMetadata encodes metadata for the JSONB column, keeping NULL for empty
+func nullableMetadata(metadata map[string]any) (any, error) {
+	if len(metadata) == 0 {
+		return nil, nil
+	}
+
+	data, err := json.Marshal(metadata)
+	if err != nil {
+		return nil, utils.NewValidationError("metadata must be valid json", err)
+	}
 
+	return string(data), nil
+}
+
+func (rs *repositoryService) GetTransactionByIdempotencyKey(ctx context.Context, clientID string, idempKey string) (*models.Transaction, error) {
+	tx := &models.Transaction{}
+
+	query := `SELECT ` + transactionColumns + ` 
+              FROM transactions 
+              WHERE client_id = $1 AND idempotency_key = $2 
+              LIMIT 1`
+
+	err := scanTransaction(rs.db.QueryRowContext(ctx, query, clientID, idempKey), tx)
 	if err != nil {
 		if err == sql.ErrNoRows {
 			return nil, nil // not found
@@ -128,28 +245,326 @@ func (rs *repositoryService) CreateTransaction(ctx context.Context, tx *models.T
 	var transactionID uuid.UUID
 	var timestamp time.Time
 
-	q1 := `INSERT INTO transactions (idempotency_key, from_account_id, to_account_id, amount, currency, status, bank_reservation_id) 
-           VALUES ($1, $2, $3, $4, $5, $6, $7) 
+	dbtx, err := rs.db.BeginTx(ctx, nil)
+	if err != nil {
+		return uuid.Nil, time.Time{}, utils.NewInternalError(err)
+	}
+	defer dbtx.Rollback()
+
+	err = checkLockToken(ctx, dbtx, tx.FromAccountID, tx.LockToken)
+	if err != nil {
+		return uuid.Nil, time.Time{}, err
+	}
+
+	metadata, err := nullableMetadata(tx.Metadata)
+	if err != nil {
+		return uuid.Nil, time.Time{}, err
+	}
+
+	q1 := `INSERT INTO transactions (idempotency_key, from_account_id, to_account_id, amount, currency, status, bank_reservation_id, description, metadata, request_hash, client_id, provider_name, external_provider_id, reservation_expires_at) 
+           VALUES ($1, $2, $3, $4, $5, $6, $7, NULLIF($8, ''), $9, NULLIF($10, ''), $11, NULLIF($12, ''), NULLIF($13, ''), $14) 
            RETURNING id, created_at`
 
-	err := rs.db.QueryRowContext(ctx, q1,
+	err = dbtx.QueryRowContext(ctx, q1,
 		tx.IdempotencyKey,
 		tx.FromAccountID,
 		tx.ToAccountID, // this will correctly handle nil
 		tx.Amount,
 		tx.Currency,
 		tx.Status,
-		tx.ReservationID).Scan(&transactionID, &timestamp)
+		tx.ReservationID,
+		tx.Description,
+		metadata,
+		tx.RequestHash,
+		tx.ClientID,
+		tx.ProviderName,
+		tx.ProviderRef,
+		tx.HoldExpiresAt).Scan(&transactionID, &timestamp)
 
 	if err != nil {
 		return uuid.Nil, time.Time{}, utils.NewConstraintError(err)
 	}
 
+	err = insertStatusHistory(ctx, dbtx, transactionID, nil, tx.Status, "created")
+	if err != nil {
+		return uuid.Nil, time.Time{}, err
+	}
+
 	tx.ID = transactionID
+	entry, err := ledger.NewEntry(ledger.EventCreated, tx)
+	if err != nil {
+		return uuid.Nil, time.Time{}, err
+	}
+
+	err = ledger.Post(ctx, dbtx, entry)
+	if err != nil {
+		return uuid.Nil, time.Time{}, err
+	}
+
+	// queue the transaction for processing, relayed to the queue after commit
+	err = insertOutboxMessage(ctx, dbtx, "transaction", models.TransactionPayload{
+		TransactionID:  transactionID,
+		IdempotencyKey: tx.IdempotencyKey,
+		Operation:      models.OperationProcess,
+	}, transactionID.String()) // idempotency keys are only unique per client
+	if err != nil {
+		return uuid.Nil, time.Time{}, err
+	}
+
+	if err := dbtx.Commit(); err != nil {
+		return uuid.Nil, time.Time{}, utils.NewInternalError(fmt.Errorf("error committing transaction: %w", err))
+	}
+
 	tx.CreatedAt = timestamp
 	return transactionID, timestamp, nil
 }
 
+func (rs *repositoryService) GetTransactionByID(ctx context.Context, txID uuid.UUID) (*models.Transaction, error) {
+	tx := &models.Transaction{}
+
+	query := `SELECT ` + transactionColumns + `
+              FROM transactions
+              WHERE id = $1`
+
+	err := scanTransaction(rs.db.QueryRowContext(ctx, query, txID), tx)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, utils.NewNotFoundError(fmt.Sprintf("transaction %s not found", txID), err)
+		}
+		return nil, utils.NewInternalError(fmt.Errorf("db error: %w", err))
+	}
+
+	return tx, nil
+}
+
+// GetTransactionByProviderRef finds the transaction a provider webhook is
+// about, ref being the provider's id for the reservation
+func (rs *repositoryService) GetTransactionByProviderRef(ctx context.Context, provider string, ref string) (*models.Transaction, error) {
+	tx := &models.Transaction{}
+
+	query := `SELECT ` + transactionColumns + `
+              FROM transactions
+              WHERE provider_name = $1 AND external_provider_id = $2`
+
+	err := scanTransaction(rs.db.QueryRowContext(ctx, query, provider, ref), tx)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, utils.NewNotFoundError(fmt.Sprintf("no transaction for %s reference %s", provider, ref), err)
+		}
+		return nil, utils.NewInternalError(fmt.Errorf("db error: %w", err))
+	}
+
+	return tx, nil
+}
+
+// ListTransactions returns transactions touching an account, newest first,
+// using keyset pagination over (created_at, id)
+func (rs *repositoryService) ListTransactions(ctx context.Context, filter models.TransactionFilter) ([]models.Transaction, error) {
+	args := []any{filter.AccountID}
+	where := []string{"(from_account_id = $1 OR to_account_id = $1)"}
+
+	addArg := func(v any) string {
+		args = append(args, v)
+		return fmt.Sprintf("$%d", len(args))
+	}
+
+	if filter.Status != nil {
+		where = append(where, "status = "+addArg(*filter.Status))
+	}
+	if filter.CreatedAfter != nil {
+		where = append(where, "created_at >= "+addArg(*filter.CreatedAfter))
+	}
+	if filter.CreatedBefore != nil {
+		where = append(where, "created_at < "+addArg(*filter.CreatedBefore))
+	}
+	for key, value := range filter.Metadata {
+		// query string values are untyped, so 5 or true also match the
+		// number or boolean stored under the key
+		var candidates []string
+		for _, v := range metadataValues(value) {
+			contains, err := json.Marshal(map[string]any{key: v})
+			if err != nil {
+				return nil, utils.NewValidationError("invalid metadata filter", err)
+			}
+			candidates = append(candidates, "metadata @> "+addArg(string(contains))+"::jsonb")
+		}
+		where = append(where, "("+strings.Join(candidates, " OR ")+")")
+	}
+	if filter.Cursor != nil {
+		createdAt := addArg(filter.Cursor.CreatedAt)
+		id := addArg(filter.Cursor.ID)
+		where = append(where, fmt.Sprintf("(created_at, id) < (%s, %s)", createdAt, id))
+	}
+
+	query := `SELECT ` + transactionColumns + `
+              FROM transactions
+              WHERE ` + strings.Join(where, " AND ") + `
+              ORDER BY created_at DESC, id DESC
+              LIMIT ` + addArg(filter.Limit)
+
+	rows, err := rs.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, utils.NewInternalError(fmt.Errorf("db error: %w", err))
+	}
+	defer rows.Close()
+
+	txs := []models.Transaction{}
+	for rows.Next() {
+		var tx models.Transaction
+		if err := scanTransaction(rows, &tx); err != nil {
+			return nil, utils.NewInternalError(fmt.Errorf("db error: %w", err))
+		}
+		txs = append(txs, tx)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, utils.NewInternalError(fmt.Errorf("db error: %w", err))
+	}
+
+	return txs, nil
+}
+
+// ListTransactionsWithExpiredReservations finds in-flight transactions whose
+// bank hold lapsed before it was captured, going by the expiry the provider
+// gave when reserving. Ones the sweeper failed on within retryAfter are
+// skipped and the rest come after those never tried, so a few stuck rows
+// can't hold up the batch.
+func (rs *repositoryService) ListTransactionsWithExpiredReservations(ctx context.Context, limit int, retryAfter time.Duration) ([]models.Transaction, error) {
+	query := `SELECT ` + transactionColumns + `
+              FROM transactions
+              WHERE status IN ('pending', 'processing')
+                AND reservation_expires_at <= NOW()
+                AND (expiry_attempted_at IS NULL OR expiry_attempted_at <= NOW() - $2 * INTERVAL '1 millisecond')
+              ORDER BY expiry_attempted_at NULLS FIRST, created_at
+              LIMIT $1`
+
+	rows, err := rs.db.QueryContext(ctx, query, limit, retryAfter.Milliseconds())
+	if err != nil {
+		return nil, utils.NewInternalError(fmt.Errorf("db error: %w", err))
+	}
+	defer rows.Close()
+
+	txs := []models.Transaction{}
+	for rows.Next() {
+		var tx models.Transaction
+		if err := scanTransaction(rows, &tx); err != nil {
+			return nil, utils.NewInternalError(fmt.Errorf("db error: %w", err))
+		}
+		txs = append(txs, tx)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, utils.NewInternalError(fmt.Errorf("db error: %w", err))
+	}
+
+	return txs, nil
+}
+
+// MarkExpiryAttempted records a failed attempt to expire a transaction, which
+// keeps the sweeper off it for a while
+func (rs *repositoryService) MarkExpiryAttempted(ctx context.Context, txID uuid.UUID) error {
+	_, err := rs.db.ExecContext(ctx, "UPDATE transactions SET expiry_attempted_at = NOW() WHERE id = $1", txID)
+	if err != nil {
+		return utils.NewInternalError(fmt.Errorf("db error: %w", err))
+	}
+
+	return nil
+}
+
+// TransitionTransaction compare-and-sets the status of a transaction, so the
+// move only happens if nobody else changed it since the caller read it. Every
+// successful transition is recorded in transaction_status_history, along
+// with the ledger entry the new status implies, in the same db transaction.
+func (rs *repositoryService) TransitionTransaction(ctx context.Context, txID uuid.UUID, from models.TransactionStatus, to models.TransactionStatus, reason string) error {
+	return rs.transitionTransaction(ctx, txID, from, to, reason, nil)
+}
+
+// TransitionTransactionForEvent is TransitionTransaction for a move a
+// provider webhook asked for. The event is recorded in the same db
+// transaction, so it's applied exactly once even if we crash part way, and a
+// second delivery racing the first gets ErrDuplicateRequest.
+func (rs *repositoryService) TransitionTransactionForEvent(ctx context.Context, event models.ProviderEvent, from models.TransactionStatus, to models.TransactionStatus, reason string) error {
+	return rs.transitionTransaction(ctx, event.TransactionID, from, to, reason, &event)
+}
+
+func (rs *repositoryService) transitionTransaction(ctx context.Context, txID uuid.UUID, from models.TransactionStatus, to models.TransactionStatus, reason string, event *models.ProviderEvent) error {
+	dbtx, err := rs.db.BeginTx(ctx, nil)
+	if err != nil {
+		return utils.NewInternalError(err)
+	}
+	defer dbtx.Rollback()
+
+	tx := &models.Transaction{ID: txID, Status: to}
+	err = dbtx.QueryRowContext(ctx,
+		`UPDATE transactions SET status = $1, updated_at = NOW() 
+         WHERE id = $2 AND status = $3
+         RETURNING from_account_id, to_account_id, amount, currency`,
+		to, txID, from).Scan(&tx.FromAccountID, &tx.ToAccountID, &tx.Amount, &tx.Currency)
+
+	if err == sql.ErrNoRows {
+		// figure out whether the row is missing or just moved on without us
+		var current models.TransactionStatus
+		err = dbtx.QueryRowContext(ctx, "SELECT status FROM transactions WHERE id = $1", txID).Scan(&current)
+		if err == sql.ErrNoRows {
+			return utils.NewNotFoundError(fmt.Sprintf("transaction %s not found", txID), err)
+		}
+		if err != nil {
+			return utils.NewInternalError(fmt.Errorf("db error: %w", err))
+		}
+
+		return utils.NewInvalidTransitionError(
+			fmt.Sprintf("transaction is %s, cannot move from %s to %s", current, from, to),
+			fmt.Errorf("stale status for %s", txID))
+	}
+	if err != nil {
+		return utils.NewInternalError(fmt.Errorf("db error: %w", err))
+	}
+
+	err = insertStatusHistory(ctx, dbtx, txID, &from, to, reason)
+	if err != nil {
+		return err
+	}
+
+	if event, ok := ledger.EventForTransition(to); ok {
+		entry, err := ledger.NewEntry(event, tx)
+		if err != nil {
+			return err
+		}
+
+		err = ledger.Post(ctx, dbtx, entry)
+		if err != nil {
+			return err
+		}
+	}
+
+	if event != nil {
+		inserted, err := insertProviderEvent(ctx, dbtx, *event)
+		if err != nil {
+			return err
+		}
+		if !inserted {
+			return utils.NewDuplicateRequestError("provider event already applied", fmt.Errorf("event %s from %s recorded twice", event.EventID, event.Provider))
+		}
+	}
+
+	if err := dbtx.Commit(); err != nil {
+		return utils.NewInternalError(fmt.Errorf("error committing transition: %w", err))
+	}
+
+	return nil
+}
+
+func insertStatusHistory(ctx context.Context, dbtx *sql.Tx, txID uuid.UUID, from *models.TransactionStatus, to models.TransactionStatus, reason string) error {
+	_, err := dbtx.ExecContext(ctx,
+		"INSERT INTO transaction_status_history (transaction_id, from_status, to_status, reason) VALUES ($1, $2, $3, $4)",
+		txID, from, to, reason)
+	if err != nil {
+		return utils.NewInternalError(fmt.Errorf("error recording status history: %w", err))
+	}
+
+	return nil
+}
+
 func (rs *repositoryService) GetExternalBankAccountID(ctx context.Context, accountID uuid.UUID) (uuid.UUID, error) {
 	var externalID uuid.UUID
 
@@ -166,3 +581,245 @@ func (rs *repositoryService) GetExternalBankAccountID(ctx context.Context, accou
 
 	return externalID, nil
 }
+
+func (rs *repositoryService) GetAccountOwner(ctx context.Context, accountID uuid.UUID) (*models.AccountOwner, error) {
+	owner := &models.AccountOwner{AccountID: accountID}
+
+	err := rs.db.QueryRowContext(ctx, `
+        SELECT u.id, u.email
+        FROM accounts a
+        JOIN users u ON u.id = a.user_id
+        WHERE a.id = $1
+    `, accountID).Scan(&owner.UserID, &owner.Email)
+
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, utils.NewNotFoundError("account not found", err)
+		}
+		return nil, utils.NewInternalError(err)
+	}
+
+	return owner, nil
+}
+
+func (rs *repositoryService) CreateAPIKey(ctx context.Context, key *models.APIKey, keyHash string) error {
+	err := rs.db.QueryRowContext(ctx, `
+        INSERT INTO api_keys (user_id, name, key_prefix, key_hash, scopes, expires_at)
+        VALUES ($1, $2, $3, $4, $5, $6)
+        RETURNING id, status, created_at
+    `, key.UserID, key.Name, key.Prefix, keyHash, pq.Array(key.Scopes), key.ExpiresAt).Scan(&key.ID, &key.Status, &key.CreatedAt)
+
+	if err != nil {
+		return utils.NewConstraintError(err)
+	}
+
+	return nil
+}
+
+// GetAPIKeyByHash looks up a key and bumps its last_used_at, returning nil
+// if no key matches
+func (rs *repositoryService) GetAPIKeyByHash(ctx context.Context, keyHash string) (*models.APIKey, error) {
+	key := &models.APIKey{}
+
+	err := rs.db.QueryRowContext(ctx, `
+        UPDATE api_keys SET last_used_at = NOW()
+        WHERE key_hash = $1
+        RETURNING id, user_id, name, key_prefix, scopes, status, expires_at, last_used_at, created_at
+    `, keyHash).Scan(
+		&key.ID,
+		&key.UserID,
+		&key.Name,
+		&key.Prefix,
+		pq.Array(&key.Scopes),
+		&key.Status,
+		&key.ExpiresAt,
+		&key.LastUsedAt,
+		&key.CreatedAt,
+	)
+
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+		return nil, utils.NewInternalError(fmt.Errorf("db error: %w", err))
+	}
+
+	return key, nil
+}
+
+func insertOutboxMessage(ctx context.Context, dbtx *sql.Tx, msgType string, payload any, dedupKey string) error {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return utils.NewInternalError(fmt.Errorf("error marshaling outbox payload: %w", err))
+	}
+
+	_, err = dbtx.ExecContext(ctx,
+		"INSERT INTO outbox (message_type, payload, dedup_key) VALUES ($1, $2, $3)",
+		msgType, string(data), dedupKey)
+	if err != nil {
+		return utils.NewInternalError(fmt.Errorf("error writing outbox message: %w", err))
+	}
+
+	return nil
+}
+
+// ClaimOutboxMessages leases a batch of unsent messages. Claimed rows are
+// pushed past the lease so other relays skip them, and come back on their
+// own if this relay dies before marking them sent or failed.
+func (rs *repositoryService) ClaimOutboxMessages(ctx context.Context, limit int, lease time.Duration) ([]models.OutboxMessage, error) {
+	rows, err := rs.db.QueryContext(ctx, `
+        UPDATE outbox
+        SET next_attempt_at = NOW() + make_interval(secs => $2), attempts = attempts + 1
+        WHERE id IN (
+            SELECT id FROM outbox
+            WHERE sent_at IS NULL AND next_attempt_at <= NOW()
+            ORDER BY id
+            LIMIT $1
+            FOR UPDATE SKIP LOCKED
+        )
+        RETURNING id, message_type, payload, dedup_key, attempts, created_at
+    `, limit, lease.Seconds())
+	if err != nil {
+		return nil, utils.NewInternalError(fmt.Errorf("db error: %w", err))
+	}
+	defer rows.Close()
+
+	var msgs []models.OutboxMessage
+	for rows.Next() {
+		var msg models.OutboxMessage
+		var payload []byte
+
+		err := rows.Scan(&msg.ID, &msg.MessageType, &payload, &msg.DedupKey, &msg.Attempts, &msg.CreatedAt)
+		if err != nil {
+			return nil, utils.NewInternalError(fmt.Errorf("db error: %w", err))
+		}
+
+		msg.Payload = payload
+		msgs = append(msgs, msg)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, utils.NewInternalError(fmt.Errorf("db error: %w", err))
+	}
+
+	return msgs, nil
+}
+
+func (rs *repositoryService) MarkOutboxSent(ctx context.Context, id int64) error {
+	_, err := rs.db.ExecContext(ctx,
+		"UPDATE outbox SET sent_at = NOW(), last_error = NULL WHERE id = $1",
+		id)
+	if err != nil {
+		return utils.NewInternalError(fmt.Errorf("db error: %w", err))
+	}
+
+	return nil
+}
+
+func (rs *repositoryService) MarkOutboxFailed(ctx context.Context, id int64, reason string, retryIn time.Duration) error {
+	_, err := rs.db.ExecContext(ctx,
+		"UPDATE outbox SET last_error = $1, next_attempt_at = NOW() + make_interval(secs => $2) WHERE id = $3",
+		reason, retryIn.Seconds(), id)
+	if err != nil {
+		return utils.NewInternalError(fmt.Errorf("db error: %w", err))
+	}
+
+	return nil
+}
+
+// ClaimProviderEvent stops concurrent deliveries of the same webhook being
+// applied twice, false means another delivery has it
+func (rs *repositoryService) ClaimProviderEvent(ctx context.Context, provider string, eventID string, expiration time.Duration) (bool, error) {
+	ok, err := rs.redis.SetNX(ctx, "webhook:"+provider+":"+eventID, time.Now().Unix(), expiration).Result()
+	if err != nil {
+		return false, utils.NewInternalError(fmt.Errorf("error claiming provider event: %w", err))
+	}
+
+	return ok, nil
+}
+
+// ReleaseProviderEvent lets a redelivery retry an event that failed to apply
+func (rs *repositoryService) ReleaseProviderEvent(ctx context.Context, provider string, eventID string) error {
+	err := rs.redis.Del(ctx, "webhook:"+provider+":"+eventID).Err()
+	if err != nil {
+		return utils.NewInternalError(fmt.Errorf("error releasing provider event: %w", err))
+	}
+
+	return nil
+}
+
+func (rs *repositoryService) ProviderEventExists(ctx context.Context, provider string, eventID string) (bool, error) {
+	var exists bool
+	err := rs.db.QueryRowContext(ctx,
+		"SELECT EXISTS (SELECT 1 FROM provider_events WHERE provider = $1 AND event_id = $2)",
+		provider, eventID).Scan(&exists)
+	if err != nil {
+		return false, utils.NewInternalError(fmt.Errorf("db error: %w", err))
+	}
+
+	return exists, nil
+}
+
+// RecordProviderEvent keeps an event that didn't move the transaction, so
+// redeliveries of it are dropped too
+func (rs *repositoryService) RecordProviderEvent(ctx context.Context, event models.ProviderEvent) error {
+	dbtx, err := rs.db.BeginTx(ctx, nil)
+	if err != nil {
+		return utils.NewInternalError(err)
+	}
+	defer dbtx.Rollback()
+
+	if _, err := insertProviderEvent(ctx, dbtx, event); err != nil {
+		return err
+	}
+
+	if err := dbtx.Commit(); err != nil {
+		return utils.NewInternalError(fmt.Errorf("error committing provider event: %w", err))
+	}
+
+	return nil
+}
+
+// insertProviderEvent reports false if the event was already recorded
+func insertProviderEvent(ctx context.Context, dbtx *sql.Tx, event models.ProviderEvent) (bool, error) {
+	res, err := dbtx.ExecContext(ctx, `
+        INSERT INTO provider_events (provider, event_id, type, transaction_id)
+        VALUES ($1, $2, $3, $4)
+        ON CONFLICT (provider, event_id) DO NOTHING
+    `, event.Provider, event.EventID, event.Type, event.TransactionID)
+	if err != nil {
+		return false, utils.NewInternalError(fmt.Errorf("error recording provider event: %w", err))
+	}
+
+	rows, err := res.RowsAffected()
+	if err != nil {
+		return false, utils.NewInternalError(err)
+	}
+
+	return rows > 0, nil
+}
+
+// checkLockToken rejects writes from a holder whose account lock expired and
+// was taken by someone newer, the token only moves forward
+func checkLockToken(ctx context.Context, dbtx *sql.Tx, accountID uuid.UUID, token int64) error {
+	if token == 0 {
+		return nil
+	}
+
+	q := `UPDATE accounts SET lock_token = $2 WHERE id = $1 AND lock_token < $2`
+
+	res, err := dbtx.ExecContext(ctx, q, accountID, token)
+	if err != nil {
+		return utils.NewInternalError(fmt.Errorf("error checking lock token: %w", err))
+	}
+
+	rows, err := res.RowsAffected()
+	if err != nil {
+		return utils.NewInternalError(err)
+	}
+	if rows == 0 {
+		return utils.NewLockTimeoutError("resource is busy, try again", fmt.Errorf("stale lock token %d for account %s", token, accountID))
+	}
+
+	return nil
+}
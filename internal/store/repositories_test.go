@@ -0,0 +1,31 @@
+package store
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestMetadataValues(t *testing.T) {
+	tests := []struct {
+		value string
+		want  []any
+	}{
+		{"gold", []any{"gold"}},
+		{"5", []any{"5", json.Number("5")}},
+		{"-2.50", []any{"-2.50", json.Number("-2.50")}},
+		{"true", []any{"true", true}},
+		{"false", []any{"false", false}},
+		{"null", []any{"null"}},
+		{"5 6", []any{"5 6"}},
+		{"5abc", []any{"5abc"}},
+		{`"5"`, []any{`"5"`}},
+	}
+
+	for _, tt := range tests {
+		got := metadataValues(tt.value)
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("metadataValues(%q) = %#v, want %#v", tt.value, got, tt.want)
+		}
+	}
+}
@@ -39,9 +39,12 @@ func InitCache(ctx context.Context, config config.Config) (*redis.Client, error)
 		DB:       0,
 	})
 
+	// redis being down isn't fatal, callers fall back while a CacheMonitor
+	// waits for it to come back
 	_, err := rds.Ping(ctx).Result()
 	if err != nil {
-		return nil, fmt.Errorf("failed to init cache: %w", err)
+		log.Printf("WARN: cache unavailable, starting degraded: %v", err)
+		return rds, nil
 	}
 
 	log.Println("connected to cache")
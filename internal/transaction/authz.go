@@ -0,0 +1,59 @@
+package transaction
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/drmitchell85/finsys/internal/auth"
+	"github.com/drmitchell85/finsys/internal/models"
+	"github.com/drmitchell85/finsys/internal/utils"
+	"github.com/google/uuid"
+)
+
+// authorizeAccount makes sure the authenticated caller owns the account
+func (ts *transactionService) authorizeAccount(ctx context.Context, accountID uuid.UUID) error {
+	principal, ok := auth.PrincipalFromContext(ctx)
+	if !ok {
+		return utils.NewUnauthorizedError("not authenticated", fmt.Errorf("no principal on context"))
+	}
+
+	owner, err := ts.rs.GetAccountOwner(ctx, accountID)
+	if err != nil {
+		return utils.WrapError(err, utils.ErrInternal, "error looking up account owner")
+	}
+
+	if owner.UserID != principal.UserID {
+		return utils.NewForbiddenError("account does not belong to caller", fmt.Errorf("user %s does not own account %s", principal.UserID, accountID))
+	}
+
+	return nil
+}
+
+// callerNamespace is the idempotency key namespace of the authenticated caller
+func callerNamespace(ctx context.Context) (string, error) {
+	principal, ok := auth.PrincipalFromContext(ctx)
+	if !ok {
+		return "", utils.NewUnauthorizedError("not authenticated", fmt.Errorf("no principal on context"))
+	}
+
+	return principal.Namespace(), nil
+}
+
+// authorizeTransaction lets the caller see a transaction if they own either
+// side of it. Anything else looks like it doesn't exist.
+func (ts *transactionService) authorizeTransaction(ctx context.Context, tx *models.Transaction) error {
+	err := ts.authorizeAccount(ctx, tx.FromAccountID)
+	if err == nil {
+		return nil
+	}
+
+	if tx.ToAccountID != nil && ts.authorizeAccount(ctx, *tx.ToAccountID) == nil {
+		return nil
+	}
+
+	if appErr, ok := utils.GetAppError(err); ok && appErr.Code == utils.ErrForbidden {
+		return utils.NewNotFoundError(fmt.Sprintf("transaction %s not found", tx.ID), err)
+	}
+
+	return err
+}
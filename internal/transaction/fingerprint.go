@@ -0,0 +1,80 @@
+package transaction
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+
+	"github.com/drmitchell85/finsys/internal/models"
+	"github.com/drmitchell85/finsys/internal/utils"
+)
+
+// requestFingerprint hashes the parts of a request an idempotency key is
+// bound to. fields holds a digest per request field so a mismatch can say
+// which ones changed without keeping the values around
+func requestFingerprint(req models.CreateTransactionRequest) (hash string, fields map[string]string) {
+	var to, metadata string
+	if req.ToAccountID != nil {
+		to = req.ToAccountID.String()
+	}
+	if len(req.Metadata) > 0 {
+		// map keys are sorted when marshaled
+		raw, _ := json.Marshal(req.Metadata)
+		metadata = string(raw)
+	}
+
+	values := map[string]string{
+		"from_account_id": req.FromAccountID.String(),
+		"to_account_id":   to,
+		"amount":          req.Amount.String(),
+		"currency":        strings.ToUpper(req.Currency),
+		"description":     req.Description,
+		"metadata":        metadata,
+	}
+
+	fields = make(map[string]string, len(values))
+	h := sha256.New()
+	for _, name := range slices.Sorted(maps.Keys(values)) {
+		sum := sha256.Sum256([]byte(values[name]))
+		fields[name] = hex.EncodeToString(sum[:])
+		fmt.Fprintf(h, "%s=%s\n", name, fields[name])
+	}
+
+	return hex.EncodeToString(h.Sum(nil)), fields
+}
+
+// requestFromTransaction rebuilds the request a stored transaction came from
+func requestFromTransaction(tx *models.Transaction) models.CreateTransactionRequest {
+	return models.CreateTransactionRequest{
+		IdempotencyKey: tx.IdempotencyKey,
+		FromAccountID:  tx.FromAccountID,
+		ToAccountID:    tx.ToAccountID,
+		Amount:         tx.Amount,
+		Currency:       tx.Currency,
+		Description:    tx.Description,
+		Metadata:       tx.Metadata,
+		ClientID:       tx.ClientID,
+	}
+}
+
+// checkFingerprint rejects reusing a key for a different request. entries
+// stored before fingerprints existed have no hash and are let through
+func checkFingerprint(req models.CreateTransactionRequest, storedHash string, storedFields map[string]string) error {
+	hash, fields := requestFingerprint(req)
+	if storedHash == "" || storedHash == hash {
+		return nil
+	}
+
+	differ := []string{}
+	for _, name := range slices.Sorted(maps.Keys(fields)) {
+		if storedFields[name] != fields[name] {
+			differ = append(differ, name)
+		}
+	}
+
+	return utils.NewIdempotencyMismatchError("idempotency key was already used with a different request", differ)
+}
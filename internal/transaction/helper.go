@@ -7,17 +7,41 @@ import (
 	"fmt"
 	"time"
 
+	"github.com/drmitchell85/finsys/internal/bank"
 	"github.com/drmitchell85/finsys/internal/models"
 	"github.com/drmitchell85/finsys/internal/utils"
 	"github.com/google/uuid"
 	"github.com/shopspring/decimal"
 )
 
-func (ts *transactionService) handleIdempotency(ctx context.Context, idempotencyKey string) (*models.CreateTransactionResponse, error) {
+// cacheKey is where a request's idempotency key lives in redis, scoped to
+// the client so two tenants can't collide on the same key
+func (ts *transactionService) cacheKey(req models.CreateTransactionRequest) string {
+	return ts.config.Idempotency.KeyPrefix + req.ClientID + ":" + req.IdempotencyKey
+}
+
+// validateIdempotencyKey keeps keys to a length and alphabet that are safe
+// to store and to use inside redis keys
+func (ts *transactionService) validateIdempotencyKey(idempotencyKey string) error {
+	if len(idempotencyKey) > ts.config.Idempotency.MaxKeyLength {
+		return utils.NewValidationError(fmt.Sprintf("idempotency key must be at most %d characters", ts.config.Idempotency.MaxKeyLength), fmt.Errorf("idempotency key too long"))
+	}
+
+	if !ts.keyPattern.MatchString(idempotencyKey) {
+		return utils.NewValidationError(fmt.Sprintf("idempotency key may only contain [%s]", ts.config.Idempotency.AllowedCharset), fmt.Errorf("invalid idempotency key %q", idempotencyKey))
+	}
+
+	return nil
+}
+
+func (ts *transactionService) handleIdempotency(ctx context.Context, req models.CreateTransactionRequest) (*models.CreateTransactionResponse, error) {
+	idempotencyKey := req.IdempotencyKey
 
-	data, err := ts.rs.CheckIdempotencyKey(ctx, idempotencyKey)
+	data, err := ts.rs.CheckIdempotencyKey(ctx, ts.cacheKey(req))
 	if err != nil {
-		return nil, utils.WrapError(err, utils.ErrInternal, "error looking up cached key")
+		// the db still knows every key that created a transaction
+		ts.logger.Warn("idempotency cache unavailable, checking db", "error", err)
+		data = ""
 	}
 
 	if data != "" {
@@ -28,11 +52,27 @@ func (ts *transactionService) handleIdempotency(ctx context.Context, idempotency
 			return nil, utils.NewInternalError(fmt.Errorf("error unmarshalling cached data: %w", err))
 		}
 
+		err = checkFingerprint(req, cache.RequestHash, cache.RequestFields)
+		if err != nil {
+			return nil, err
+		}
+
+		if cache.ErrorStatus != 0 {
+			return nil, &utils.AppError{
+				Code:     utils.ErrorCode(cache.ErrorCode),
+				Message:  cache.ErrorMessage,
+				Details:  cache.ErrorDetails,
+				Status:   cache.ErrorStatus,
+				Replayed: true,
+			}
+		}
+
 		// Create a proper response from the cached data
 		resp := &models.CreateTransactionResponse{
 			TransactionID: cache.TransactionID,
 			Status:        cache.Status,
 			CreatedAt:     cache.CreatedAt,
+			Replayed:      true,
 		}
 
 		// If the cache contains a full response object, unmarshal it
@@ -42,6 +82,7 @@ func (ts *transactionService) handleIdempotency(ctx context.Context, idempotency
 				// If we can't unmarshal the cached response, just use what we have
 				return resp, nil
 			}
+			cachedResp.Replayed = true
 			return &cachedResp, nil
 		}
 
@@ -49,73 +90,206 @@ func (ts *transactionService) handleIdempotency(ctx context.Context, idempotency
 	}
 
 	// Not in cache, check if already exists in DB
-	existingTx, err := ts.rs.GetTransactionByIdempotencyKey(ctx, idempotencyKey)
+	existingTx, err := ts.rs.GetTransactionByIdempotencyKey(ctx, req.ClientID, idempotencyKey)
 	if err != nil {
 		return nil, utils.WrapError(err, utils.ErrInternal, "error checking existing transaction")
 	}
 
 	// If found in DB but not in cache, reconstruct and add to cache
 	if existingTx != nil {
-		resp := &models.CreateTransactionResponse{
-			TransactionID: existingTx.ID,
-			Status:        existingTx.Status,
-			CreatedAt:     existingTx.CreatedAt,
-		}
-
-		// Re-cache the found transaction
-		responseRaw, _ := json.Marshal(resp)
-		err = ts.rs.StoreIdempotencyKey(ctx, idempotencyKey, &models.IdempotencyCache{
-			TransactionID: existingTx.ID,
-			Status:        existingTx.Status,
-			Response:      responseRaw,
-			CreatedAt:     existingTx.CreatedAt,
-		}, 24*time.Hour)
+		return ts.replayTransaction(ctx, req, existingTx)
+	}
+
+	return nil, nil
+}
+
+// replayTransaction answers a reused key with the transaction it already
+// created, as long as the request is the same one
+func (ts *transactionService) replayTransaction(ctx context.Context, req models.CreateTransactionRequest, existingTx *models.Transaction) (*models.CreateTransactionResponse, error) {
+	_, storedFields := requestFingerprint(requestFromTransaction(existingTx))
+	err := checkFingerprint(req, existingTx.RequestHash, storedFields)
+	if err != nil {
+		return nil, err
+	}
+
+	resp := &models.CreateTransactionResponse{
+		TransactionID: existingTx.ID,
+		Status:        existingTx.Status,
+		CreatedAt:     existingTx.CreatedAt,
+		Replayed:      true,
+	}
+
+	// Re-cache the found transaction
+	responseRaw, _ := json.Marshal(resp)
+	err = ts.rs.StoreIdempotencyKey(ctx, ts.cacheKey(req), &models.IdempotencyCache{
+		TransactionID: existingTx.ID,
+		Status:        existingTx.Status,
+		Response:      responseRaw,
+		CreatedAt:     existingTx.CreatedAt,
+		RequestHash:   existingTx.RequestHash,
+		RequestFields: storedFields,
+	}, ts.config.Idempotency.TTL)
+	if err != nil {
+		ts.logger.Warn("failed to re-cache transaction", "error", err)
+		// continue anyway
+	}
+
+	return resp, nil
+}
+
+// cacheableErrors are the failures that would come out the same on a retry.
+// anything else, internal errors, timeouts and busy resources, leaves the
+// key free to try again
+var cacheableErrors = map[utils.ErrorCode]bool{
+	utils.ErrValidation:        true,
+	utils.ErrNotFound:          true,
+	utils.ErrInsufficientFunds: true,
+	utils.ErrAccountNotFound:   true,
+}
+
+// cacheFailure stores a deterministic failure under the idempotency key so
+// retries are answered with it instead of running again
+func (ts *transactionService) cacheFailure(ctx context.Context, req models.CreateTransactionRequest, err error) {
+	appErr, ok := utils.GetAppError(err)
+	if !ok || !cacheableErrors[appErr.Code] {
+		return
+	}
+
+	requestHash, requestFields := requestFingerprint(req)
+	err = ts.rs.StoreIdempotencyKey(ctx, ts.cacheKey(req), &models.IdempotencyCache{
+		CreatedAt:     time.Now(),
+		ErrorStatus:   utils.HTTPStatus(appErr.Code),
+		ErrorCode:     string(appErr.Code),
+		ErrorMessage:  appErr.Message,
+		ErrorDetails:  appErr.Details,
+		RequestHash:   requestHash,
+		RequestFields: requestFields,
+	}, ts.config.Idempotency.TTL)
+	if err != nil {
+		ts.logger.Warn("failed to cache failed request", "error", err)
+	}
+}
+
+// inFlightPoll is how often a duplicate request checks for the first result
+const inFlightPoll = 100 * time.Millisecond
+
+// claimIdempotencyKey marks the key in flight for this request. if another
+// request holds it, wait for that one's result and return it instead, or
+// give up with ErrDuplicateRequest once the wait runs out. claimed is false
+// when the cache is down, the db unique constraint is all that's left then
+func (ts *transactionService) claimIdempotencyKey(ctx context.Context, req models.CreateTransactionRequest) (*models.CreateTransactionResponse, bool, error) {
+	idempotencyKey := req.IdempotencyKey
+	deadline := time.Now().Add(ts.config.Idempotency.InFlightWait)
+
+	for {
+		claimed, err := ts.rs.MarkIdempotencyInFlight(ctx, ts.cacheKey(req), ts.config.Idempotency.InFlightTTL)
 		if err != nil {
-			ts.logger.Warn("failed to re-cache transaction", "error", err)
-			// continue anyway
+			ts.logger.Warn("idempotency cache unavailable, not claiming key", "error", err)
+			return nil, false, nil
 		}
 
-		return resp, nil
-	}
+		// the first request may have finished between the lookup and the claim
+		resp, err := ts.handleIdempotency(ctx, req)
+		if claimed && (err != nil || resp != nil) {
+			if clrErr := ts.rs.ClearIdempotencyInFlight(ctx, ts.cacheKey(req)); clrErr != nil {
+				ts.logger.Error("failed to clear in flight key", "idempotency_key", idempotencyKey, "error", clrErr)
+			}
+		}
+		if err != nil {
+			return nil, false, err
+		} else if resp != nil {
+			return resp, false, nil
+		} else if claimed {
+			return nil, true, nil
+		}
 
-	return nil, nil
+		if time.Now().Add(inFlightPoll).After(deadline) {
+			return nil, false, utils.NewDuplicateRequestError("a request with this idempotency key is already in progress", fmt.Errorf("idempotency key %s in flight", idempotencyKey))
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, false, utils.NewInternalError(ctx.Err())
+		case <-time.After(inFlightPoll):
+		}
+	}
 }
 
-func (ts *transactionService) validateTransactionRequest(ctx context.Context, req models.CreateTransactionRequest) (uuid.UUID, error) {
-	err := ts.rs.AccountExists(req.FromAccountID)
+// validateTransactionRequest checks the request and finds the providers
+// that could hold the funds, in the order to try them
+func (ts *transactionService) validateTransactionRequest(ctx context.Context, req models.CreateTransactionRequest) (uuid.UUID, []*bank.Provider, error) {
+	err := validateDetails(req.Description, req.Metadata)
+	if err != nil {
+		return uuid.UUID{}, nil, err
+	}
+
+	err = ts.rs.AccountExists(req.FromAccountID)
 	if err != nil {
-		return uuid.UUID{}, utils.WrapError(err, utils.ErrNotFound, "error while checking if account exists")
+		return uuid.UUID{}, nil, utils.WrapError(err, utils.ErrNotFound, "error while checking if account exists")
 	}
 
 	if req.ToAccountID != nil {
 		err = ts.rs.AccountExists(*req.ToAccountID)
 		if err != nil {
-			return uuid.UUID{}, utils.WrapError(err, utils.ErrNotFound, "error while checking if account exists")
+			return uuid.UUID{}, nil, utils.WrapError(err, utils.ErrNotFound, "error while checking if account exists")
 		}
 	}
 
-	bankAccountID, err := ts.rs.GetExternalBankAccountID(ctx, req.FromAccountID)
+	// checked before routing, providers are picked by currency
+	err = validateCurrency(req.Currency, req.Amount)
 	if err != nil {
-		return uuid.UUID{}, utils.WrapError(err, utils.ErrInternal, "failed to get external bank account")
+		return uuid.UUID{}, nil, utils.WrapError(err, utils.ErrValidation, "error while validating currency")
 	}
 
-	hasFunds, err := ts.bs.HasSufficientFunds(ctx, bankAccountID, req.Amount)
-
+	bankAccountID, err := ts.rs.GetExternalBankAccountID(ctx, req.FromAccountID)
 	if err != nil {
-		return uuid.UUID{}, utils.WrapError(err, utils.ErrInternal, "failed to check account balance")
-	} else if !hasFunds {
-		return uuid.UUID{}, utils.NewValidationError("insufficient funds", fmt.Errorf("funds error"))
+		return uuid.UUID{}, nil, utils.WrapError(err, utils.ErrInternal, "failed to get external bank account")
 	}
 
-	err = validateCurrency(req.Currency, req.Amount)
+	providers, err := ts.bank.Route(req.Currency, req.Amount)
 	if err != nil {
-		return uuid.UUID{}, utils.WrapError(err, utils.ErrValidation, "error while validating currency")
+		return uuid.UUID{}, nil, err
 	}
 
-	return bankAccountID, nil
+	return bankAccountID, providers, nil
 }
 
-func (ts *transactionService) createAndCacheTransaction(ctx context.Context, req models.CreateTransactionRequest, reservationID uuid.UUID) (*models.CreateTransactionResponse, uuid.UUID, error) {
+// reserveFunds checks the balance and places the hold with the first
+// provider that takes the call. An open breaker means the call was never
+// made, so either step failing that way moves on to the next provider.
+func (ts *transactionService) reserveFunds(ctx context.Context, req models.CreateTransactionRequest, bankAccountID uuid.UUID, providers []*bank.Provider) (*bank.Provider, uuid.UUID, time.Time, error) {
+	for _, provider := range providers {
+		hasFunds, err := provider.HasSufficientFunds(ctx, bankAccountID, req.Amount)
+		if errors.Is(err, bank.ErrCircuitOpen) {
+			// tripped since routing, the next provider is the failover
+			ts.logger.Warn("provider unavailable, failing over", "provider", provider.Name, "error", err)
+			continue
+		}
+
+		if err != nil {
+			return nil, uuid.UUID{}, time.Time{}, utils.WrapError(err, utils.ErrInternal, "failed to check account balance")
+		} else if !hasFunds {
+			return nil, uuid.UUID{}, time.Time{}, utils.NewInsufficientFundsError("insufficient funds", fmt.Errorf("funds error"))
+		}
+
+		resID, expiresAt, err := provider.ReserveFunds(ctx, bankAccountID, req.Amount)
+		if errors.Is(err, bank.ErrCircuitOpen) {
+			ts.logger.Warn("provider unavailable, failing over", "provider", provider.Name, "error", err)
+			continue
+		}
+		if err != nil {
+			return nil, uuid.UUID{}, time.Time{}, utils.WrapError(err, utils.ErrValidation, "error reserving funds")
+		}
+
+		return provider, resID, expiresAt, nil
+	}
+
+	return nil, uuid.UUID{}, time.Time{}, utils.NewUpstreamUnavailableError("bank is unavailable, try again later", fmt.Errorf("every provider for %s is unavailable", req.Currency))
+}
+
+func (ts *transactionService) createAndCacheTransaction(ctx context.Context, req models.CreateTransactionRequest, provider string, reservationID uuid.UUID, expiresAt time.Time, lockToken int64) (*models.CreateTransactionResponse, error) {
+	requestHash, requestFields := requestFingerprint(req)
+
 	txID, txTime, err := ts.rs.CreateTransaction(ctx, &models.Transaction{
 		IdempotencyKey: req.IdempotencyKey,
 		FromAccountID:  req.FromAccountID,
@@ -124,6 +298,14 @@ func (ts *transactionService) createAndCacheTransaction(ctx context.Context, req
 		Currency:       req.Currency,
 		Status:         models.TransactionPending,
 		ReservationID:  reservationID,
+		HoldExpiresAt:  &expiresAt,
+		ProviderName:   provider,
+		ProviderRef:    reservationID.String(),
+		Description:    req.Description,
+		Metadata:       req.Metadata,
+		LockToken:      lockToken,
+		RequestHash:    requestHash,
+		ClientID:       req.ClientID,
 	})
 
 	if err != nil {
@@ -132,35 +314,20 @@ func (ts *transactionService) createAndCacheTransaction(ctx context.Context, req
 		if errors.As(err, &appErr) && appErr.Code == utils.ErrUniqueConstraint {
 			// Race condition - transaction was created between our check and insert
 			// Try to fetch it again
-			existingTx, fetchErr := ts.rs.GetTransactionByIdempotencyKey(ctx, req.IdempotencyKey)
+			existingTx, fetchErr := ts.rs.GetTransactionByIdempotencyKey(ctx, req.ClientID, req.IdempotencyKey)
 			if fetchErr != nil {
-				return nil, uuid.UUID{}, utils.WrapError(fetchErr, utils.ErrInternal, "failed to fetch constraint violation")
+				return nil, utils.WrapError(fetchErr, utils.ErrInternal, "failed to fetch constraint violation")
 			}
 
 			if existingTx != nil {
 				// Use the existing transaction
-				resp := &models.CreateTransactionResponse{
-					TransactionID: existingTx.ID,
-					Status:        existingTx.Status,
-					CreatedAt:     existingTx.CreatedAt,
-				}
-
-				// Cache it
-				responseRaw, _ := json.Marshal(resp)
-				ts.rs.StoreIdempotencyKey(ctx, req.IdempotencyKey, &models.IdempotencyCache{
-					TransactionID: existingTx.ID,
-					Status:        existingTx.Status,
-					Response:      responseRaw,
-					CreatedAt:     existingTx.CreatedAt,
-				}, 24*time.Hour)
-
-				return resp, uuid.UUID{}, nil
+				return ts.replayTransaction(ctx, req, existingTx)
 			}
 
-			return nil, uuid.UUID{}, utils.WrapError(err, utils.ErrInternal, "transaction exists but couldn't be retrieved")
+			return nil, utils.WrapError(err, utils.ErrInternal, "transaction exists but couldn't be retrieved")
 		}
 
-		return nil, uuid.UUID{}, utils.WrapError(err, utils.ErrInternal, "failed to create transaction entry")
+		return nil, utils.WrapError(err, utils.ErrInternal, "failed to create transaction entry")
 	}
 
 	resp := &models.CreateTransactionResponse{
@@ -171,18 +338,54 @@ func (ts *transactionService) createAndCacheTransaction(ctx context.Context, req
 
 	// Cache the new transaction
 	responseRaw, _ := json.Marshal(resp)
-	err = ts.rs.StoreIdempotencyKey(ctx, req.IdempotencyKey, &models.IdempotencyCache{
+	err = ts.rs.StoreIdempotencyKey(ctx, ts.cacheKey(req), &models.IdempotencyCache{
 		TransactionID: txID,
 		Status:        models.TransactionPending,
 		Response:      responseRaw,
 		CreatedAt:     txTime,
-	}, 24*time.Hour)
+		RequestHash:   requestHash,
+		RequestFields: requestFields,
+	}, ts.config.Idempotency.TTL)
 	if err != nil {
 		ts.logger.Warn("failed to cache transaction", "error", err)
 		// continue anyway
 	}
 
-	return resp, txID, nil
+	return resp, nil
+}
+
+// limits on the free-form fields clients can attach to a transaction
+const (
+	maxDescriptionLength   = 1000
+	maxMetadataKeys        = 50
+	maxMetadataKeyLength   = 40
+	maxMetadataValueLength = 500 // length of the json-encoded value
+)
+
+func validateDetails(description string, metadata map[string]any) error {
+	if len(description) > maxDescriptionLength {
+		return utils.NewValidationError(fmt.Sprintf("description cannot exceed %d characters", maxDescriptionLength), fmt.Errorf("description too long"))
+	}
+
+	if len(metadata) > maxMetadataKeys {
+		return utils.NewValidationError(fmt.Sprintf("metadata cannot have more than %d keys", maxMetadataKeys), fmt.Errorf("too many metadata keys"))
+	}
+
+	for key, value := range metadata {
+		if key == "" || len(key) > maxMetadataKeyLength {
+			return utils.NewValidationError(fmt.Sprintf("metadata keys must be 1-%d characters", maxMetadataKeyLength), fmt.Errorf("invalid metadata key %q", key))
+		}
+
+		encoded, err := json.Marshal(value)
+		if err != nil {
+			return utils.NewValidationError(fmt.Sprintf("metadata value for %q is not valid json", key), err)
+		}
+		if len(encoded) > maxMetadataValueLength {
+			return utils.NewValidationError(fmt.Sprintf("metadata value for %q cannot exceed %d characters", key, maxMetadataValueLength), fmt.Errorf("metadata value too long"))
+		}
+	}
+
+	return nil
 }
 
 func validateCurrency(currency string, amount decimal.Decimal) error {
@@ -0,0 +1,144 @@
+package transaction
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/drmitchell85/finsys/internal/models"
+	"github.com/drmitchell85/finsys/internal/utils"
+	"github.com/google/uuid"
+)
+
+// ProcessTransaction runs the operation carried by a queued transaction
+// message. A returned error means the work should be retried, so the message
+// must stay on the queue for redrive.
+func (ts *transactionService) ProcessTransaction(ctx context.Context, payload models.TransactionPayload) error {
+	tx, err := ts.rs.GetTransactionByID(ctx, payload.TransactionID)
+	if err != nil {
+		return utils.WrapError(err, utils.ErrInternal, "error fetching transaction")
+	}
+
+	// messages queued before operations were set carry none
+	if payload.Operation != "" && payload.Operation != models.OperationProcess {
+		// retrying won't make it known, drop it
+		ts.logger.Warn("unknown transaction operation, skipping", "transaction_id", tx.ID, "operation", payload.Operation)
+		return nil
+	}
+
+	return ts.processTransaction(ctx, tx)
+}
+
+// processTransaction drives a transaction from pending through processing to
+// completed or failed
+func (ts *transactionService) processTransaction(ctx context.Context, tx *models.Transaction) error {
+	var err error
+
+	switch tx.Status {
+	case models.TransactionPending:
+		err = ts.transition(ctx, tx, models.TransactionProcessing, "picked up by worker")
+		if err != nil {
+			return utils.WrapError(err, utils.ErrInternal, "error moving transaction to processing")
+		}
+
+	case models.TransactionProcessing:
+		// a previous attempt died mid-flight, pick up where it left off
+		ts.logger.Info("resuming transaction already in processing", "transaction_id", tx.ID)
+
+	default:
+		// already finalized, this is a redelivery
+		ts.logger.Info("transaction already finalized, skipping", "transaction_id", tx.ID, "status", tx.Status)
+		return nil
+	}
+
+	err = ts.settleTransaction(ctx, tx)
+	if err != nil {
+		if utils.IsTransient(err) {
+			// leave in processing and let the queue redeliver
+			return err
+		}
+
+		ts.logger.Warn("transaction failed", "transaction_id", tx.ID, "error", err)
+		reason := err.Error()
+
+		// give the held funds back before marking it failed, a failed
+		// transaction is never picked up again to retry the release
+		err = ts.releaseReservation(ctx, tx)
+		if err != nil {
+			return err
+		}
+
+		err = ts.transition(ctx, tx, models.TransactionFailed, reason)
+		if err != nil {
+			if appErr, ok := utils.GetAppError(err); ok && appErr.Code == utils.ErrInvalidTransition {
+				// the provider's release webhook got there first
+				ts.logger.Info("transaction already finalized by provider", "transaction_id", tx.ID)
+				return nil
+			}
+			return utils.WrapError(err, utils.ErrInternal, "error moving transaction to failed")
+		}
+		return nil
+	}
+
+	err = ts.transition(ctx, tx, models.TransactionCompleted, "settled")
+	if err != nil {
+		if appErr, ok := utils.GetAppError(err); ok && appErr.Code == utils.ErrInvalidTransition {
+			// the provider's capture webhook got there first
+			ts.logger.Info("transaction already finalized by provider", "transaction_id", tx.ID)
+			return nil
+		}
+		return utils.WrapError(err, utils.ErrInternal, "error moving transaction to completed")
+	}
+
+	ts.logger.Info("transaction completed", "transaction_id", tx.ID)
+	return nil
+}
+
+// settleTransaction captures the held funds at the bank. Capture is
+// idempotent, so a retry after a crash past this point is safe.
+func (ts *transactionService) settleTransaction(ctx context.Context, tx *models.Transaction) error {
+	if tx.ReservationID == uuid.Nil {
+		return utils.NewValidationError("transaction has no bank reservation", fmt.Errorf("missing reservation for %s", tx.ID))
+	}
+
+	bankAccountID, err := ts.rs.GetExternalBankAccountID(ctx, tx.FromAccountID)
+	if err != nil {
+		return utils.WrapError(err, utils.ErrInternal, "failed to get external bank account")
+	}
+
+	// the funds can only be captured where they were reserved
+	provider, err := ts.bank.Provider(tx.ProviderName)
+	if err != nil {
+		return err
+	}
+
+	err = provider.CaptureFunds(ctx, bankAccountID, tx.ReservationID)
+	if err != nil {
+		return utils.WrapError(err, utils.ErrInternal, "error capturing funds")
+	}
+
+	return nil
+}
+
+// releaseReservation drops the bank hold for a transaction that won't settle
+func (ts *transactionService) releaseReservation(ctx context.Context, tx *models.Transaction) error {
+	if tx.ReservationID == uuid.Nil {
+		return nil
+	}
+
+	bankAccountID, err := ts.rs.GetExternalBankAccountID(ctx, tx.FromAccountID)
+	if err != nil {
+		return utils.WrapError(err, utils.ErrInternal, "failed to get external bank account")
+	}
+
+	provider, err := ts.bank.Provider(tx.ProviderName)
+	if err != nil {
+		return err
+	}
+
+	err = provider.ReleaseFunds(ctx, bankAccountID, tx.ReservationID)
+	if err != nil {
+		return utils.WrapError(err, utils.ErrInternal, "error releasing funds")
+	}
+
+	return nil
+}
@@ -0,0 +1,151 @@
+package transaction
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+
+	"github.com/drmitchell85/finsys/internal/ledger"
+	"github.com/drmitchell85/finsys/internal/models"
+	"github.com/drmitchell85/finsys/internal/utils"
+	"github.com/google/uuid"
+)
+
+const (
+	DefaultListLimit = 50
+	MaxListLimit     = 100
+)
+
+func (ts *transactionService) GetTransaction(ctx context.Context, txID uuid.UUID) (*models.Transaction, error) {
+	tx, err := ts.rs.GetTransactionByID(ctx, txID)
+	if err != nil {
+		return nil, utils.WrapError(err, utils.ErrInternal, "error fetching transaction")
+	}
+
+	if err := ts.authorizeTransaction(ctx, tx); err != nil {
+		return nil, err
+	}
+
+	return tx, nil
+}
+
+func (ts *transactionService) GetTransactionByIdempotencyKey(ctx context.Context, idempotencyKey string) (*models.Transaction, error) {
+	clientID, err := callerNamespace(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	tx, err := ts.rs.GetTransactionByIdempotencyKey(ctx, clientID, idempotencyKey)
+	if err != nil {
+		return nil, utils.WrapError(err, utils.ErrInternal, "error fetching transaction")
+	}
+
+	if tx == nil {
+		return nil, utils.NewNotFoundError("no transaction for idempotency key", fmt.Errorf("idempotency key %q not found", idempotencyKey))
+	}
+
+	if err := ts.authorizeTransaction(ctx, tx); err != nil {
+		return nil, err
+	}
+
+	return tx, nil
+}
+
+func (ts *transactionService) ListTransactions(ctx context.Context, filter models.TransactionFilter) (*models.ListTransactionsResponse, error) {
+	if filter.AccountID == uuid.Nil {
+		return nil, utils.NewValidationError("account_id is required", fmt.Errorf("missing account id"))
+	}
+
+	if err := ts.authorizeAccount(ctx, filter.AccountID); err != nil {
+		return nil, err
+	}
+
+	if filter.Limit <= 0 {
+		filter.Limit = DefaultListLimit
+	} else if filter.Limit > MaxListLimit {
+		filter.Limit = MaxListLimit
+	}
+
+	// ask for one extra row to know if there's another page
+	pageSize := filter.Limit
+	filter.Limit++
+
+	txs, err := ts.rs.ListTransactions(ctx, filter)
+	if err != nil {
+		return nil, utils.WrapError(err, utils.ErrInternal, "error listing transactions")
+	}
+
+	resp := &models.ListTransactionsResponse{
+		Transactions: txs,
+	}
+
+	if len(txs) > pageSize {
+		resp.Transactions = txs[:pageSize]
+		resp.HasMore = true
+
+		last := resp.Transactions[pageSize-1]
+		resp.NextCursor = EncodeCursor(models.TransactionCursor{
+			CreatedAt: last.CreatedAt,
+			ID:        last.ID,
+		})
+	}
+
+	return resp, nil
+}
+
+// GetTransactionEntries returns the journal entries a transaction has
+// posted, oldest first
+func (ts *transactionService) GetTransactionEntries(ctx context.Context, txID uuid.UUID) ([]ledger.JournalEntry, error) {
+	// fetching it first applies the same access check as reading it
+	if _, err := ts.GetTransaction(ctx, txID); err != nil {
+		return nil, err
+	}
+
+	entries, err := ts.ls.GetEntries(ctx, txID)
+	if err != nil {
+		return nil, utils.WrapError(err, utils.ErrInternal, "error fetching journal entries")
+	}
+
+	return entries, nil
+}
+
+// GetAccountBalances derives every bucket of an account's balance in one
+// currency from its postings
+func (ts *transactionService) GetAccountBalances(ctx context.Context, accountID uuid.UUID, currency string) ([]*ledger.Balance, error) {
+	if err := ts.authorizeAccount(ctx, accountID); err != nil {
+		return nil, err
+	}
+
+	balances := make([]*ledger.Balance, 0, len(ledger.Kinds))
+	for _, kind := range ledger.Kinds {
+		balance, err := ts.ls.GetBalance(ctx, accountID, kind, currency)
+		if err != nil {
+			return nil, utils.WrapError(err, utils.ErrInternal, "error fetching balance")
+		}
+		balances = append(balances, balance)
+	}
+
+	return balances, nil
+}
+
+// EncodeCursor turns a cursor into an opaque token for clients
+func EncodeCursor(cursor models.TransactionCursor) string {
+	data, _ := json.Marshal(cursor)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// DecodeCursor parses a token produced by EncodeCursor
+func DecodeCursor(token string) (*models.TransactionCursor, error) {
+	data, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return nil, utils.NewValidationError("invalid cursor", err)
+	}
+
+	var cursor models.TransactionCursor
+	if err := json.Unmarshal(data, &cursor); err != nil {
+		return nil, utils.NewValidationError("invalid cursor", err)
+	}
+
+	return &cursor, nil
+}
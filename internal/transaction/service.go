@@ -2,80 +2,153 @@ package transaction
 
 import (
 	"context"
-	"fmt"
-	"log"
+	"errors"
 	"log/slog"
+	"regexp"
 
 	"github.com/drmitchell85/finsys/internal/bank"
+	"github.com/drmitchell85/finsys/internal/config"
+	"github.com/drmitchell85/finsys/internal/ledger"
 	"github.com/drmitchell85/finsys/internal/messenger"
 	"github.com/drmitchell85/finsys/internal/models"
 	"github.com/drmitchell85/finsys/internal/store"
-	"github.com/drmitchell85/finsys/internal/utils"
+	"github.com/google/uuid"
 )
 
 type TransactionService interface {
 	CreateTransaction(ctx context.Context, req models.CreateTransactionRequest) (*models.CreateTransactionResponse, error)
-	handleIdempotency(ctx context.Context, idempotencyKey string) (*models.CreateTransactionResponse, error)
+	GetTransaction(ctx context.Context, txID uuid.UUID) (*models.Transaction, error)
+	GetTransactionByIdempotencyKey(ctx context.Context, idempotencyKey string) (*models.Transaction, error)
+	ListTransactions(ctx context.Context, filter models.TransactionFilter) (*models.ListTransactionsResponse, error)
+	GetTransactionEntries(ctx context.Context, txID uuid.UUID) ([]ledger.JournalEntry, error)
+	GetAccountBalances(ctx context.Context, accountID uuid.UUID, currency string) ([]*ledger.Balance, error)
+	ProcessTransaction(ctx context.Context, payload models.TransactionPayload) error
+	ExpireStaleTransactions(ctx context.Context, limit int) (int, error)
+	HandleProviderWebhook(ctx context.Context, providerName string, signature string, body []byte) error
+	handleIdempotency(ctx context.Context, req models.CreateTransactionRequest) (*models.CreateTransactionResponse, error)
 }
 
 type transactionService struct {
 	rs     store.RepositoryService
+	ls     ledger.LedgerService
 	qs     *messenger.QueueService
-	bs     bank.BankService
+	bank   bank.Router
+	locker store.Locker
 	logger *slog.Logger
+	config config.Config
+
+	keyPattern *regexp.Regexp
 }
 
-func NewTransactionService(rs store.RepositoryService, qs *messenger.QueueService, bs bank.BankService, logger *slog.Logger) TransactionService {
+func NewTransactionService(rs store.RepositoryService, ls ledger.LedgerService, qs *messenger.QueueService, providers bank.Router, locker store.Locker, logger *slog.Logger, config config.Config) TransactionService {
 	return &transactionService{
 		rs:     rs,
+		ls:     ls,
 		qs:     qs,
-		bs:     bs,
+		bank:   providers,
+		locker: locker,
 		logger: logger,
+		config: config,
+
+		// checked when the config is loaded
+		keyPattern: regexp.MustCompile("^[" + config.Idempotency.AllowedCharset + "]+$"),
 	}
 }
 
 func (ts *transactionService) CreateTransaction(ctx context.Context, req models.CreateTransactionRequest) (*models.CreateTransactionResponse, error) {
+	err := ts.authorizeAccount(ctx, req.FromAccountID)
+	if err != nil {
+		return nil, err
+	}
 
-	fmt.Println("CreateTransaction() called...")
+	req.ClientID, err = callerNamespace(ctx)
+	if err != nil {
+		return nil, err
+	}
 
-	resp, err := ts.handleIdempotency(ctx, req.IdempotencyKey)
+	err = ts.validateIdempotencyKey(req.IdempotencyKey)
 	if err != nil {
 		return nil, err
-	} else if resp != nil {
-		return resp, nil
 	}
 
-	bankAccountID, err := ts.validateTransactionRequest(ctx, req)
+	resp, err := ts.handleIdempotency(ctx, req)
 	if err != nil {
 		return nil, err
+	} else if resp != nil {
+		return resp, nil
 	}
 
-	resID, err := ts.bs.ReserveFunds(ctx, bankAccountID, req.Amount)
+	// make sure only one request with this key does the work, duplicates
+	// arriving alongside get the first one's result
+	resp, claimed, err := ts.claimIdempotencyKey(ctx, req)
 	if err != nil {
-		return nil, utils.WrapError(err, utils.ErrValidation, "error reserving funds")
+		return nil, err
+	} else if resp != nil {
+		return resp, nil
+	}
+	if claimed {
+		defer func() {
+			if clrErr := ts.rs.ClearIdempotencyInFlight(ctx, ts.cacheKey(req)); clrErr != nil {
+				ts.logger.Error("failed to clear in flight key", "idempotency_key", req.IdempotencyKey, "error", clrErr)
+			}
+		}()
 	}
 
-	resp, txID, err := ts.createAndCacheTransaction(ctx, req, resID)
+	resp, err = ts.executeTransaction(ctx, req)
 	if err != nil {
+		// retries with the same key get the same answer
+		ts.cacheFailure(ctx, req, err)
 		return nil, err
 	}
 
-	fmt.Println("moving on to enqueue...")
+	return resp, nil
+}
 
-	// Enqueue for processing
-	_, err = ts.qs.EnqueueTransaction(ctx, txID, req.IdempotencyKey, "default")
-	if err != nil {
-		return nil, utils.WrapError(err, utils.ErrInternal, "failed to enqueue transaction")
+// executeTransaction reserves the funds and records the transaction, the
+// caller holds the idempotency key
+func (ts *transactionService) executeTransaction(ctx context.Context, req models.CreateTransactionRequest) (*models.CreateTransactionResponse, error) {
+	// one request at a time moves money out of an account, otherwise two
+	// requests can both pass the balance check before either reserves
+	// without redis there's no lock, ReserveFunds locking the bank account
+	// row still keeps the balance from going negative
+	var lockToken int64
+	lock, err := ts.locker.Acquire(ctx, "account:"+req.FromAccountID.String(), ts.config.Lock.TTL, ts.config.Lock.Wait)
+	if errors.Is(err, store.ErrCacheUnavailable) {
+		ts.logger.Warn("lock unavailable, continuing without it", "account_id", req.FromAccountID, "error", err)
+	} else if err != nil {
+		return nil, err
+	} else {
+		lockToken = lock.Token
+		defer func() {
+			if relErr := lock.Release(ctx); relErr != nil {
+				ts.logger.Error("failed to release account lock", "account_id", req.FromAccountID, "error", relErr)
+			}
+		}()
 	}
 
-	fmt.Println("checking queue...")
+	bankAccountID, providers, err := ts.validateTransactionRequest(ctx, req)
+	if err != nil {
+		return nil, err
+	}
 
-	mgs, err := ts.qs.ReceiveTransactions()
+	provider, resID, expiresAt, err := ts.reserveFunds(ctx, req, bankAccountID, providers)
 	if err != nil {
-		log.Println("\nerr: \n", err)
+		return nil, err
 	}
 
-	fmt.Printf("mgs: %+v", mgs)
+	// the transaction is queued for processing through the outbox, written
+	// in the same db transaction as the insert
+	resp, err := ts.createAndCacheTransaction(ctx, req, provider.Name, resID, expiresAt, lockToken)
+	if err != nil || resp.Replayed {
+		// nothing will ever settle this hold, either the insert failed or
+		// another request owns the key, hand the funds back
+		if relErr := provider.ReleaseFunds(ctx, bankAccountID, resID); relErr != nil {
+			ts.logger.Error("failed to release reservation", "reservation_id", resID, "error", relErr)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
 
 	return resp, nil
 }
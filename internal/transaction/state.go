@@ -0,0 +1,74 @@
+package transaction
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/drmitchell85/finsys/internal/models"
+	"github.com/drmitchell85/finsys/internal/utils"
+)
+
+// transitions lists every legal status move. Final statuses have no entry.
+var transitions = map[models.TransactionStatus][]models.TransactionStatus{
+	models.TransactionPending: {
+		models.TransactionProcessing,
+		models.TransactionFailed,
+		models.TransactionCancelled,
+	},
+	models.TransactionProcessing: {
+		models.TransactionCompleted,
+		models.TransactionFailed,
+	},
+}
+
+// CanTransition reports whether a transaction may move from one status to another
+func CanTransition(from models.TransactionStatus, to models.TransactionStatus) bool {
+	for _, next := range transitions[from] {
+		if next == to {
+			return true
+		}
+	}
+	return false
+}
+
+func validateTransition(from models.TransactionStatus, to models.TransactionStatus) error {
+	if !CanTransition(from, to) {
+		return utils.NewInvalidTransitionError(
+			fmt.Sprintf("cannot move transaction from %s to %s", from, to),
+			fmt.Errorf("illegal transition %s -> %s", from, to))
+	}
+	return nil
+}
+
+// transition guards the move against the state machine before doing the
+// compare-and-set in the db, then updates the in-memory copy to match. The
+// owner is told about every transaction that fails.
+func (ts *transactionService) transition(ctx context.Context, tx *models.Transaction, to models.TransactionStatus, reason string) error {
+	return ts.transitionForEvent(ctx, tx, to, reason, nil)
+}
+
+// transitionForEvent is transition for a move a provider event asked for,
+// recording the event with it when there is one
+func (ts *transactionService) transitionForEvent(ctx context.Context, tx *models.Transaction, to models.TransactionStatus, reason string, event *models.ProviderEvent) error {
+	err := validateTransition(tx.Status, to)
+	if err != nil {
+		return err
+	}
+
+	if event != nil {
+		err = ts.rs.TransitionTransactionForEvent(ctx, *event, tx.Status, to, reason)
+	} else {
+		err = ts.rs.TransitionTransaction(ctx, tx.ID, tx.Status, to, reason)
+	}
+	if err != nil {
+		return err
+	}
+
+	ts.logger.Info("transaction status changed", "transaction_id", tx.ID, "from", tx.Status, "to", to, "reason", reason)
+	tx.Status = to
+
+	if to == models.TransactionFailed {
+		ts.notifyFailure(ctx, tx, reason)
+	}
+	return nil
+}
@@ -0,0 +1,100 @@
+package transaction
+
+import (
+	"context"
+
+	"github.com/drmitchell85/finsys/internal/models"
+	"github.com/drmitchell85/finsys/internal/utils"
+)
+
+const (
+	reasonReservationExpired      = "bank reservation expired"
+	reasonReservationCaptured     = "bank reservation already captured"
+	notificationTransactionFailed = "transaction_failed"
+)
+
+// ExpireStaleTransactions fails in-flight transactions whose bank hold ran
+// out before they settled, returning how many were failed
+func (ts *transactionService) ExpireStaleTransactions(ctx context.Context, limit int) (int, error) {
+	txs, err := ts.rs.ListTransactionsWithExpiredReservations(ctx, limit, ts.config.Sweeper.RetryAfter)
+	if err != nil {
+		return 0, utils.WrapError(err, utils.ErrInternal, "error finding expired reservations")
+	}
+
+	expired := 0
+	for i := range txs {
+		tx := &txs[i]
+
+		failed, err := ts.expireTransaction(ctx, tx)
+		if err != nil {
+			if appErr, ok := utils.GetAppError(err); ok && appErr.Code == utils.ErrInvalidTransition {
+				// the worker got to it first
+				continue
+			}
+			ts.logger.Error("error expiring transaction", "transaction_id", tx.ID, "error", err)
+
+			// back off so it doesn't take a slot in every batch
+			if err := ts.rs.MarkExpiryAttempted(ctx, tx.ID); err != nil {
+				ts.logger.Warn("failed to record expiry attempt", "transaction_id", tx.ID, "error", err)
+			}
+			continue
+		}
+
+		if failed {
+			expired++
+		}
+	}
+
+	return expired, nil
+}
+
+// expireTransaction releases the hold and fails the transaction. A hold the
+// bank captured before it lapsed means the money moved, so the transaction
+// is completed instead and isn't counted as expired.
+func (ts *transactionService) expireTransaction(ctx context.Context, tx *models.Transaction) (bool, error) {
+	err := ts.releaseReservation(ctx, tx)
+	if appErr, ok := utils.GetAppError(err); ok && appErr.Code == utils.ErrReservationCaptured {
+		return false, ts.completeCaptured(ctx, tx)
+	}
+	if err != nil {
+		return false, err
+	}
+
+	return true, ts.transition(ctx, tx, models.TransactionFailed, reasonReservationExpired)
+}
+
+// completeCaptured finishes a transaction whose capture went through at the
+// bank without us recording it, e.g. the worker died before the transition
+// and the capture webhook never came
+func (ts *transactionService) completeCaptured(ctx context.Context, tx *models.Transaction) error {
+	ts.logger.Warn("expired reservation was captured, completing transaction", "transaction_id", tx.ID)
+
+	if tx.Status == models.TransactionPending {
+		err := ts.transition(ctx, tx, models.TransactionProcessing, reasonReservationCaptured)
+		if err != nil {
+			return err
+		}
+	}
+
+	return ts.transition(ctx, tx, models.TransactionCompleted, reasonReservationCaptured)
+}
+
+// notifyFailure tells the account owner a transaction failed. The
+// transaction is already failed, so errors are only logged.
+func (ts *transactionService) notifyFailure(ctx context.Context, tx *models.Transaction, reason string) {
+	owner, err := ts.rs.GetAccountOwner(ctx, tx.FromAccountID)
+	if err != nil {
+		ts.logger.Warn("failed to look up owner for notification", "transaction_id", tx.ID, "error", err)
+		return
+	}
+
+	_, err = ts.qs.EnqueueNotification(ctx, owner.UserID, notificationTransactionFailed, owner.Email, tx.ID.String(), map[string]any{
+		"transaction_id": tx.ID,
+		"amount":         tx.Amount,
+		"currency":       tx.Currency,
+		"reason":         reason,
+	})
+	if err != nil {
+		ts.logger.Warn("failed to enqueue failure notification", "transaction_id", tx.ID, "error", err)
+	}
+}
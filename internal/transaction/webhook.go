@@ -0,0 +1,131 @@
+package transaction
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/drmitchell85/finsys/internal/bank"
+	"github.com/drmitchell85/finsys/internal/models"
+	"github.com/drmitchell85/finsys/internal/store"
+	"github.com/drmitchell85/finsys/internal/utils"
+)
+
+const (
+	reasonCapturedByProvider = "captured by provider"
+	reasonReleasedByProvider = "released by provider"
+)
+
+// HandleProviderWebhook applies a signed event from a payment provider. A nil
+// error acknowledges the event, including duplicates and events for
+// transactions we don't know, so the provider stops redelivering.
+func (ts *transactionService) HandleProviderWebhook(ctx context.Context, providerName string, signature string, body []byte) error {
+	provider, err := ts.bank.Provider(providerName)
+	if err != nil || provider.Name != providerName {
+		return utils.NewNotFoundError(fmt.Sprintf("unknown provider %s", providerName), err)
+	}
+
+	err = provider.VerifyWebhook(signature, body)
+	if err != nil {
+		ts.logger.Warn("rejected provider webhook", "provider", providerName, "error", err)
+		return err
+	}
+
+	var event bank.WebhookEvent
+	if err := json.Unmarshal(body, &event); err != nil {
+		return utils.NewValidationError("invalid webhook payload", err)
+	}
+	if event.ID == "" {
+		return utils.NewValidationError("webhook event id is required", fmt.Errorf("missing event id from %s", providerName))
+	}
+
+	// the db remembers applied events for good, recorded with the status change
+	seen, err := ts.rs.ProviderEventExists(ctx, providerName, event.ID)
+	if err != nil {
+		return err
+	}
+	if seen {
+		ts.logger.Info("provider webhook already applied, skipping", "provider", providerName, "event_id", event.ID)
+		return nil
+	}
+
+	// redis holds off deliveries racing this one, they're told to come back
+	// rather than acknowledged in case this one fails
+	claimed, err := ts.rs.ClaimProviderEvent(ctx, providerName, event.ID, ts.config.Bank.WebhookDedupTTL)
+	if errors.Is(err, store.ErrCacheUnavailable) {
+		ts.logger.Warn("cache unavailable, deduplicating webhook in db only", "provider", providerName, "event_id", event.ID)
+	} else if err != nil {
+		return err
+	} else if !claimed {
+		return utils.NewDuplicateRequestError("event is already being processed", fmt.Errorf("event %s from %s in flight", event.ID, providerName))
+	} else {
+		defer ts.releaseProviderEvent(ctx, providerName, event.ID)
+	}
+
+	return ts.applyProviderEvent(ctx, providerName, event)
+}
+
+// applyProviderEvent moves the transaction the event is about to the status
+// the provider reports, recording the event in the same db transaction
+func (ts *transactionService) applyProviderEvent(ctx context.Context, providerName string, event bank.WebhookEvent) error {
+	tx, err := ts.rs.GetTransactionByProviderRef(ctx, providerName, event.ReservationID.String())
+	if err != nil {
+		if appErr, ok := utils.GetAppError(err); ok && appErr.Code == utils.ErrNotFound {
+			// a hold we released before the transaction was recorded
+			ts.logger.Warn("provider webhook for unknown reservation", "provider", providerName, "event_id", event.ID, "reservation_id", event.ReservationID)
+			return nil
+		}
+		return err
+	}
+
+	record := &models.ProviderEvent{
+		Provider:      providerName,
+		EventID:       event.ID,
+		Type:          event.Type,
+		TransactionID: tx.ID,
+	}
+
+	switch event.Type {
+	case bank.EventReservationCaptured:
+		if tx.Status == models.TransactionPending {
+			err = ts.transition(ctx, tx, models.TransactionProcessing, reasonCapturedByProvider)
+			if err != nil {
+				break
+			}
+		}
+		err = ts.transitionForEvent(ctx, tx, models.TransactionCompleted, reasonCapturedByProvider, record)
+
+	case bank.EventReservationReleased:
+		err = ts.transitionForEvent(ctx, tx, models.TransactionFailed, reasonReleasedByProvider, record)
+
+	case bank.EventReservationExpired:
+		err = ts.transitionForEvent(ctx, tx, models.TransactionFailed, reasonReservationExpired, record)
+
+	default:
+		ts.logger.Warn("ignoring unknown provider event type", "provider", providerName, "event_id", event.ID, "type", event.Type)
+		return ts.rs.RecordProviderEvent(ctx, *record)
+	}
+
+	if appErr, ok := utils.GetAppError(err); ok {
+		switch appErr.Code {
+		case utils.ErrInvalidTransition:
+			// we already got here ourselves, or the transaction is final
+			ts.logger.Info("provider event doesn't change transaction", "transaction_id", tx.ID, "status", tx.Status, "type", event.Type)
+			return ts.rs.RecordProviderEvent(ctx, *record)
+		case utils.ErrDuplicateRequest:
+			// another delivery applied it first
+			ts.logger.Info("provider webhook already applied, skipping", "provider", providerName, "event_id", event.ID)
+			return nil
+		}
+	}
+
+	return err
+}
+
+func (ts *transactionService) releaseProviderEvent(ctx context.Context, providerName string, eventID string) {
+	err := ts.rs.ReleaseProviderEvent(ctx, providerName, eventID)
+	if err != nil && !errors.Is(err, store.ErrCacheUnavailable) {
+		ts.logger.Error("failed to release provider event", "provider", providerName, "event_id", eventID, "error", err)
+	}
+}
@@ -3,6 +3,7 @@ package utils
 import (
 	"errors"
 	"fmt"
+	"net/http"
 	"strings"
 )
 
@@ -15,20 +16,34 @@ const (
 	ErrNotFound     ErrorCode = "NOT_FOUND"
 	ErrUnauthorized ErrorCode = "UNAUTHORIZED"
 	ErrForbidden    ErrorCode = "FORBIDDEN"
+	ErrRateLimited  ErrorCode = "RATE_LIMITED"
+	ErrUnavailable  ErrorCode = "SERVICE_UNAVAILABLE"
+
+	// upstream errors
+	ErrUpstreamUnavailable ErrorCode = "UPSTREAM_UNAVAILABLE" // the bank is down or timing out, retryable
 
 	// business logic errors
-	ErrInsufficientFunds ErrorCode = "INSUFFICIENT_FUNDS"
-	ErrAccountNotFound   ErrorCode = "ACCOUNT_NOT_FOUND"
-	ErrDuplicateRequest  ErrorCode = "DUPLICATE_REQUEST"
-	ErrUniqueConstraint  ErrorCode = "UNIQUE_CONSTRAINT_VIOLATION"
+	ErrInsufficientFunds   ErrorCode = "INSUFFICIENT_FUNDS"
+	ErrAccountNotFound     ErrorCode = "ACCOUNT_NOT_FOUND"
+	ErrDuplicateRequest    ErrorCode = "DUPLICATE_REQUEST"
+	ErrUniqueConstraint    ErrorCode = "UNIQUE_CONSTRAINT_VIOLATION"
+	ErrInvalidTransition   ErrorCode = "INVALID_STATUS_TRANSITION"
+	ErrLockTimeout         ErrorCode = "LOCK_TIMEOUT" // retryable, the resource was busy
+	ErrIdempotencyMismatch ErrorCode = "IDEMPOTENCY_KEY_MISMATCH"
+	ErrReservationCaptured ErrorCode = "RESERVATION_CAPTURED" // the money already moved, it can't be released
 	// add more as needed
 )
 
 // AppError standardizes error handling across the application
 type AppError struct {
-	Code    ErrorCode `json:"code"`
-	Message string    `json:"message"`
-	Err     error     `json:"-"` // original error (not serialized)
+	Code    ErrorCode      `json:"code"`
+	Message string         `json:"message"`
+	Details map[string]any `json:"details,omitempty"` // extra context for the caller
+	Err     error          `json:"-"`                 // original error (not serialized)
+
+	// set when replaying a failure cached under an idempotency key
+	Status   int  `json:"-"`
+	Replayed bool `json:"-"`
 }
 
 func (e *AppError) Error() string {
@@ -72,10 +87,54 @@ func NewInternalError(err error) *AppError {
 	return NewAppError(ErrInternal, "Internal server error", err)
 }
 
+func NewUnauthorizedError(message string, err error) *AppError {
+	return NewAppError(ErrUnauthorized, message, err)
+}
+
 func NewForbiddenError(message string, err error) *AppError {
 	return NewAppError(ErrForbidden, message, err)
 }
 
+func NewUnavailableError(message string, err error) *AppError {
+	return NewAppError(ErrUnavailable, message, err)
+}
+
+func NewUpstreamUnavailableError(message string, err error) *AppError {
+	return NewAppError(ErrUpstreamUnavailable, message, err)
+}
+
+func NewInsufficientFundsError(message string, err error) *AppError {
+	return NewAppError(ErrInsufficientFunds, message, err)
+}
+
+func NewInvalidTransitionError(message string, err error) *AppError {
+	return NewAppError(ErrInvalidTransition, message, err)
+}
+
+func NewRateLimitedError(message string, err error) *AppError {
+	return NewAppError(ErrRateLimited, message, err)
+}
+
+func NewDuplicateRequestError(message string, err error) *AppError {
+	return NewAppError(ErrDuplicateRequest, message, err)
+}
+
+func NewReservationCapturedError(message string, err error) *AppError {
+	return NewAppError(ErrReservationCaptured, message, err)
+}
+
+func NewLockTimeoutError(message string, err error) *AppError {
+	return NewAppError(ErrLockTimeout, message, err)
+}
+
+// NewIdempotencyMismatchError lists the request fields that differ from the
+// request the key was first used with
+func NewIdempotencyMismatchError(message string, fields []string) *AppError {
+	appErr := NewAppError(ErrIdempotencyMismatch, message, nil)
+	appErr.Details = map[string]any{"fields": fields}
+	return appErr
+}
+
 func NewConstraintError(err error) *AppError {
 	errMsg := err.Error()
 	if strings.Contains(errMsg, "duplicate key") || strings.Contains(errMsg, "unique constraint") {
@@ -104,3 +163,40 @@ func GetAppError(err error) (*AppError, bool) {
 	}
 	return nil, false
 }
+
+// HTTPStatus maps an error code to the status it is answered with
+func HTTPStatus(code ErrorCode) int {
+	switch code {
+	case ErrValidation:
+		return http.StatusBadRequest
+	case ErrNotFound:
+		return http.StatusNotFound
+	case ErrUnauthorized:
+		return http.StatusUnauthorized
+	case ErrForbidden:
+		return http.StatusForbidden
+	case ErrRateLimited:
+		return http.StatusTooManyRequests
+	case ErrUnavailable, ErrUpstreamUnavailable:
+		return http.StatusServiceUnavailable
+	case ErrInsufficientFunds, ErrAccountNotFound:
+		return http.StatusBadRequest
+	case ErrInvalidTransition, ErrDuplicateRequest, ErrLockTimeout, ErrReservationCaptured:
+		return http.StatusConflict
+	case ErrIdempotencyMismatch:
+		return http.StatusUnprocessableEntity
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// IsTransient reports whether an error might go away on retry: anything
+// that isn't an AppError, internal errors and unavailable upstreams
+func IsTransient(err error) bool {
+	appErr, ok := GetAppError(err)
+	if !ok {
+		return true
+	}
+
+	return appErr.Code == ErrInternal || appErr.Code == ErrUpstreamUnavailable
+}
@@ -0,0 +1,214 @@
+package worker
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"log/slog"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/drmitchell85/finsys/internal/bank"
+	"github.com/drmitchell85/finsys/internal/config"
+	"github.com/drmitchell85/finsys/internal/ledger"
+	"github.com/drmitchell85/finsys/internal/messenger"
+	"github.com/drmitchell85/finsys/internal/models"
+	"github.com/drmitchell85/finsys/internal/outbox"
+	"github.com/drmitchell85/finsys/internal/store"
+	"github.com/drmitchell85/finsys/internal/transaction"
+	"github.com/redis/go-redis/v9"
+)
+
+// how long to back off after the queue itself errors out
+const receiveErrorBackoff = 5 * time.Second
+
+type Worker struct {
+	db           *sql.DB
+	queueService *messenger.QueueService // for consuming from the queue
+	redis        *redis.Client           // for idempotency cache
+	cache        *store.CacheMonitor     // tracks whether redis is up
+	logger       *slog.Logger            // structured logging
+	config       *config.Config          // app configuration
+	ts           transaction.TransactionService
+	relay        *outbox.Relay // publishes the outbox to the queue
+	wg           sync.WaitGroup
+	ctx          context.Context // cancelled on shutdown to stop polling
+	cancel       context.CancelFunc
+	done         chan struct{}
+}
+
+func (w *Worker) Start() error {
+	ctx := w.ctx
+	defer close(w.done)
+	defer w.wg.Wait()
+
+	w.wg.Add(1)
+	go func() {
+		defer w.wg.Done()
+		w.cache.Run(ctx)
+	}()
+
+	w.wg.Add(1)
+	go func() {
+		defer w.wg.Done()
+		w.relay.Run(ctx)
+	}()
+
+	if w.config.Sweeper.Enabled {
+		w.wg.Add(1)
+		go func() {
+			defer w.wg.Done()
+			w.runSweeper(ctx)
+		}()
+	}
+
+	log.Println("worker polling transaction queue")
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		default:
+		}
+
+		msgs, err := w.queueService.ReceiveTransactions(ctx)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			w.logger.Error("error receiving transactions", "error", err)
+			select {
+			case <-ctx.Done():
+				return nil
+			case <-time.After(receiveErrorBackoff):
+			}
+			continue
+		}
+
+		// let in-flight messages finish even if shutdown was requested
+		for _, msg := range msgs {
+			w.handleMessage(context.WithoutCancel(ctx), msg)
+		}
+	}
+}
+
+// runSweeper periodically fails transactions whose bank hold expired
+func (w *Worker) runSweeper(ctx context.Context) {
+	ticker := time.NewTicker(w.config.Sweeper.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		expired, err := w.ts.ExpireStaleTransactions(ctx, w.config.Sweeper.BatchSize)
+		if err != nil {
+			w.logger.Error("error sweeping expired reservations", "error", err)
+			continue
+		}
+		if expired > 0 {
+			w.logger.Info("failed transactions with expired reservations", "count", expired)
+		}
+	}
+}
+
+func (w *Worker) Shutdown(ctx context.Context) {
+	w.cancel()
+
+	select {
+	case <-w.done:
+	case <-ctx.Done():
+		log.Printf("worker did not finish in-flight messages: %v", ctx.Err())
+	}
+
+	if err := w.db.Close(); err != nil {
+		log.Printf("error closing db connection: %v", err)
+	}
+}
+
+// handleMessage processes a single queue message. The message is only
+// deleted once the transaction is finalized, otherwise it becomes visible
+// again and is redriven to the dlq after enough receives.
+func (w *Worker) handleMessage(ctx context.Context, msg messenger.ReceivedMessage) {
+	var envelope models.Message
+	if err := json.Unmarshal([]byte(msg.Body), &envelope); err != nil {
+		w.logger.Error("error decoding message", "message_id", msg.ID, "error", err)
+		return
+	}
+
+	if envelope.Type != messenger.QueueTransaction {
+		w.logger.Error("unexpected message type on transaction queue", "message_id", msg.ID, "type", envelope.Type)
+		return
+	}
+
+	var payload models.TransactionPayload
+	if err := json.Unmarshal(envelope.Payload, &payload); err != nil {
+		w.logger.Error("error decoding transaction payload", "message_id", msg.ID, "error", err)
+		return
+	}
+
+	err := w.ts.ProcessTransaction(ctx, payload)
+	if err != nil {
+		w.logger.Error("error processing transaction, leaving for redrive",
+			"transaction_id", payload.TransactionID,
+			"receive_count", msg.ReceiveCount,
+			"error", err)
+		return
+	}
+
+	err = w.queueService.DeleteMessage(ctx, messenger.QueueTransaction, msg.ReceiptHandle)
+	if err != nil {
+		// the transaction is finalized so a redelivery is a no-op
+		w.logger.Warn("error deleting processed message", "transaction_id", payload.TransactionID, "error", err)
+	}
+}
+
+func NewWorker() (*Worker, error) {
+	ctx := context.Background()
+	worker := Worker{done: make(chan struct{})}
+	worker.ctx, worker.cancel = context.WithCancel(ctx)
+
+	config, err := config.Load()
+	if err != nil {
+		return nil, fmt.Errorf("error loading config: %s", err)
+	}
+	worker.config = config
+
+	db, err := store.InitDB(*config)
+	if err != nil {
+		return nil, fmt.Errorf("error starting db: %s", err)
+	}
+	worker.db = db
+
+	rds, err := store.InitCache(ctx, *config)
+	if err != nil {
+		return nil, fmt.Errorf("error starting cache: %s", err)
+	}
+	worker.redis = rds
+	worker.cache = store.NewCacheMonitor(rds, config.Redis.HealthInterval)
+
+	queue, err := messenger.NewQueue(*config, db)
+	if err != nil {
+		return nil, fmt.Errorf("error starting queue: %s", err)
+	}
+	worker.queueService = messenger.NewQueueService(queue)
+	worker.logger = slog.New(slog.NewJSONHandler(os.Stdout, nil))
+
+	rs := store.NewRepositoryService(worker.db, worker.redis)
+	providers, err := bank.NewRouter(*config, worker.db, &http.Client{Timeout: config.Bank.Timeout})
+	if err != nil {
+		return nil, fmt.Errorf("error starting bank service: %s", err)
+	}
+	locker := store.NewLocker(worker.redis, worker.db)
+	worker.ts = transaction.NewTransactionService(rs, ledger.NewLedgerService(worker.db), worker.queueService, providers, locker, worker.logger, *config)
+	worker.relay = outbox.NewRelay(rs, worker.queueService, worker.logger, config.Outbox)
+
+	return &worker, nil
+}